@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// authLevel задает, какой доступ требуется для маршрута
+type authLevel int
+
+const (
+	// authPublic — маршрут открыт без ключа, например проверки оркестратора и мониторинга
+	authPublic authLevel = iota
+	// authUser — требуется любой действующий API-ключ
+	authUser
+	// authAdmin — требуется API-ключ с правами администратора
+	authAdmin
+)
+
+// apiKey хранит хэш допустимого ключа и уровень доступа, который он дает
+type apiKey struct {
+	sum   [sha256.Size]byte
+	level authLevel
+}
+
+// addAPIKey разрешает доступ к API с ключом key на уровне level. Хранится только хэш, поэтому ключи
+// разной длины сравниваются за одинаковое время.
+func (h *HTTPHandler) addAPIKey(key string, level authLevel) {
+	h.apiKeys = append(h.apiKeys, apiKey{sum: sha256.Sum256([]byte(key)), level: level})
+}
+
+// apiKeyLevel возвращает уровень доступа ключа или authPublic для неизвестного ключа. Ключ
+// проверяется по всем допустимым без раннего выхода, чтобы время ответа не выдавало, с каким
+// из ключей совпадение.
+func (h *HTTPHandler) apiKeyLevel(key string) authLevel {
+	sum := sha256.Sum256([]byte(key))
+	level := authPublic
+	for _, allowed := range h.apiKeys {
+		match := subtle.ConstantTimeCompare(sum[:], allowed.sum[:])
+		level = authLevel(subtle.ConstantTimeSelect(match, int(allowed.level), int(level)))
+	}
+	return level
+}
+
+// bearerToken возвращает ключ из заголовка Authorization: Bearer <key>
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(key), true
+}
+
+// requireAuth пропускает запрос к next, только если API-ключ из заголовка Authorization дает
+// уровень доступа не ниже level. Без ключа или с неизвестным ключом отвечает 401, с ключом
+// без прав администратора на административном маршруте — 403. Без настроенных ключей
+// (AUTH_DISABLED=true) проверка не выполняется.
+func (h *HTTPHandler) requireAuth(level authLevel, next http.Handler) http.Handler {
+	if level == authPublic {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.apiKeys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		granted := authPublic
+		if key, ok := bearerToken(r); ok {
+			granted = h.apiKeyLevel(key)
+		}
+		switch {
+		case granted == authPublic:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			h.responseError(w, r, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		case granted < level:
+			h.responseError(w, r, http.StatusForbidden, "admin API key required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config содержит все параметры сервиса. Он заполняется один раз при старте функцией loadConfig,
+// проверяется методом validate, и уже из него собираются хранилище, обработчик и HTTP-сервер.
+type Config struct {
+	// Store выбирает хранилище: postgres или memory (без базы данных, например для локальной разработки)
+	Store     string
+	DB        DBConfig
+	Transfers storeConfig
+	Handler   handlerConfig
+	// Currencies перечисляет валюты, в которых можно создавать кошельки, помимо базовой
+	Currencies []string
+	// TransferRateLimit задает частоту переводов с одного кошелька в секунду, 0 отключает ограничение;
+	// TransferRateBurst — допустимый всплеск
+	TransferRateLimit float64
+	TransferRateBurst int
+	// MaxResponseBytes ограничивает размер JSON-ответа, 0 отключает ограничение
+	MaxResponseBytes int64
+	Auth             AuthConfig
+	CORS             CORSConfig
+	Server           ServerConfig
+}
+
+// DBConfig содержит параметры подключения к базе данных
+type DBConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+	// StatementTimeout ограничивает время выполнения одного запроса на сервере, включая ожидание
+	// блокировок, чтобы перевод не ждал освобождения строки бесконечно; 0 отключает ограничение
+	StatementTimeout time.Duration
+	// Параметры пула соединений. MaxOpenConns должен оставаться ниже max_connections
+	// сервера с учетом всех экземпляров сервиса: переводы удерживают соединение на время блокировки
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// ConnectTimeout ограничивает ожидание готовности базы данных при старте
+	ConnectTimeout time.Duration
+	// TxAttempts задает число попыток транзакции перевода при конфликте сериализации
+	TxAttempts int
+	// ReconcileInterval задает период сверки кэша счетчиков транзакций с историей
+	ReconcileInterval time.Duration
+	// TransactionsImmutable включает триггер, запрещающий изменять журнал транзакций
+	TransactionsImmutable bool
+	// ReadinessQuery выполняется проверкой готовности после пинга, чтобы убедиться, что схема
+	// пригодна к работе; пустая строка ограничивает проверку пингом
+	ReadinessQuery string
+}
+
+// DSN строит строку подключения; значения заключаются в кавычки,
+// чтобы пустой пароль или пробелы не ломали разбор строки
+func (c DBConfig) DSN() string {
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	dsn := fmt.Sprintf("host='%s' port=%d user='%s' password='%s' dbname='%s' sslmode='%s'",
+		quote.Replace(c.Host), c.Port, quote.Replace(c.User), quote.Replace(c.Password), quote.Replace(c.Name), quote.Replace(c.SSLMode))
+	// Неизвестные драйверу параметры передаются серверу как параметры сеанса
+	if c.StatementTimeout > 0 {
+		dsn += fmt.Sprintf(" statement_timeout=%d", c.StatementTimeout.Milliseconds())
+	}
+	return dsn
+}
+
+// AuthConfig содержит API-ключи. Disabled отключает проверку ключей для локальной разработки.
+type AuthConfig struct {
+	Disabled bool
+	Keys     []string
+	// AdminKeys дают доступ и к административным маршрутам
+	AdminKeys []string
+}
+
+// CORSConfig содержит параметры CORS; пустой AllowedOrigins отключает CORS
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowCredentials bool
+	// AllowedHeaders дополняет стандартный список заголовков запроса
+	AllowedHeaders []string
+	MaxAge         time.Duration
+}
+
+// policy создает политику CORS или возвращает nil, если CORS не настроен
+func (c CORSConfig) policy() (*corsPolicy, error) {
+	if len(c.AllowedOrigins) == 0 {
+		return nil, nil
+	}
+	policy, err := newCORSPolicy(c.AllowedOrigins, c.AllowCredentials)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range c.AllowedHeaders {
+		policy.allowedHeaders = append(policy.allowedHeaders, http.CanonicalHeaderKey(header))
+	}
+	policy.maxAge = c.MaxAge
+	return policy, nil
+}
+
+// ServerConfig содержит параметры HTTP-сервера
+type ServerConfig struct {
+	Addr string
+	// TLSCertFile и TLSKeyFile задают сертификат и ключ в формате PEM; без них сервер работает по HTTP
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion uint16
+	// Таймауты защищают от медленных клиентов, удерживающих соединения (slowloris)
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout ограничивает ожидание текущих запросов при остановке
+	ShutdownTimeout time.Duration
+}
+
+// tlsConfig загружает сертификат при старте, чтобы ошибка в файлах обнаруживалась сразу,
+// а не при первом подключении; без TLS возвращает nil
+func (c ServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   c.TLSMinVersion,
+	}, nil
+}
+
+// configKeyPattern описывает имя параметра в файле конфигурации — имя переменной окружения
+var configKeyPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// readConfigFile читает JSON-файл конфигурации, заданный флагом -config. Файл содержит объект, ключи
+// которого совпадают с именами переменных окружения, например {"DB_HOST": "db", "HTTP_ADDR": ":8443"}.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	file := make(map[string]string, len(values))
+	for key, value := range values {
+		if !configKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid config file %s: invalid key %q", path, key)
+		}
+		switch v := value.(type) {
+		case string:
+			file[key] = v
+		case json.Number:
+			file[key] = v.String()
+		case bool:
+			file[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("invalid config file %s: %s must be a string, number or boolean", path, key)
+		}
+	}
+	return file, nil
+}
+
+// configSource отдает значения параметров. Переменная окружения имеет приоритет над файлом,
+// поэтому пароли можно не хранить в файле.
+type configSource struct {
+	file      map[string]string
+	lookupEnv func(key string) (string, bool)
+	// errs накапливает ошибки разбора, чтобы сообщить обо всех неверных параметрах сразу
+	errs []error
+}
+
+func (s *configSource) lookup(key string) (string, bool) {
+	if v, ok := s.lookupEnv(key); ok {
+		return v, true
+	}
+	v, ok := s.file[key]
+	return v, ok
+}
+
+func (s *configSource) invalid(key, value string) {
+	s.errs = append(s.errs, fmt.Errorf("invalid %s: %q", key, value))
+}
+
+func (s *configSource) string(key, def string) string {
+	if v, ok := s.lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+// bool принимает только true и false
+func (s *configSource) bool(key string, def bool) bool {
+	v, ok := s.lookup(key)
+	switch {
+	case !ok || v == "":
+		return def
+	case v == "true":
+		return true
+	case v == "false":
+		return false
+	}
+	s.invalid(key, v)
+	return def
+}
+
+func (s *configSource) int(key string, def int) int {
+	v, ok := s.lookup(key)
+	if !ok || v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		s.invalid(key, v)
+		return def
+	}
+	return n
+}
+
+func (s *configSource) int64(key string, def int64) int64 {
+	v, ok := s.lookup(key)
+	if !ok || v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		s.invalid(key, v)
+		return def
+	}
+	return n
+}
+
+func (s *configSource) float(key string, def float64) float64 {
+	v, ok := s.lookup(key)
+	if !ok || v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		s.invalid(key, v)
+		return def
+	}
+	return f
+}
+
+func (s *configSource) duration(key string, def time.Duration) time.Duration {
+	v, ok := s.lookup(key)
+	if !ok || v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		s.invalid(key, v)
+		return def
+	}
+	return d
+}
+
+func (s *configSource) amount(key string, def Amount) Amount {
+	v, ok := s.lookup(key)
+	if !ok || v == "" {
+		return def
+	}
+	a, err := ParseAmount(v)
+	if err != nil {
+		s.invalid(key, v)
+		return def
+	}
+	return a
+}
+
+// list разбирает значения через запятую, пропуская пустые
+func (s *configSource) list(key string) []string {
+	var values []string
+	for _, v := range strings.Split(s.string(key, ""), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// choice возвращает одно из допустимых значений параметра
+func (s *configSource) choice(key, def string, allowed ...string) string {
+	v := s.string(key, def)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	s.invalid(key, v)
+	return def
+}
+
+// loadConfig читает конфигурацию из переменных окружения и необязательного файла path (пустая строка —
+// без файла), подставляя значения по умолчанию для незаданных параметров, и проверяет ее
+func loadConfig(path string, lookupEnv func(key string) (string, bool)) (Config, error) {
+	src := &configSource{lookupEnv: lookupEnv}
+	if path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		src.file = file
+	}
+
+	transfers := defaultStoreConfig()
+	handler := defaultHandlerConfig()
+	cfg := Config{
+		Store: src.choice("STORE", "postgres", "postgres", "memory"),
+		DB: DBConfig{
+			Host:                  src.string("DB_HOST", "localhost"),
+			Port:                  src.int("DB_PORT", 5432),
+			User:                  src.string("DB_USER", "root"),
+			Password:              src.string("DB_PASSWORD", ""),
+			Name:                  src.string("DB_NAME", "admindb"),
+			SSLMode:               src.string("DB_SSLMODE", "disable"),
+			StatementTimeout:      src.duration("DB_STATEMENT_TIMEOUT", 30*time.Second),
+			MaxOpenConns:          src.int("DB_MAX_OPEN_CONNS", 25),
+			MaxIdleConns:          src.int("DB_MAX_IDLE_CONNS", 10),
+			ConnMaxLifetime:       src.duration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+			ConnectTimeout:        src.duration("DB_CONNECT_TIMEOUT", 30*time.Second),
+			TxAttempts:            src.int("DB_TX_RETRY_ATTEMPTS", 3),
+			ReconcileInterval:     src.duration("TX_COUNT_RECONCILE_INTERVAL", time.Hour),
+			TransactionsImmutable: src.bool("TRANSACTIONS_IMMUTABLE", true),
+			ReadinessQuery:        src.string("DB_READINESS_QUERY", ""),
+		},
+		Transfers: storeConfig{
+			maxTransfer:          src.amount("MAX_TRANSFER", transfers.maxTransfer),
+			autoCreateRecipient:  src.bool("AUTO_CREATE_RECIPIENT", transfers.autoCreateRecipient),
+			duplicateWindow:      src.duration("DUPLICATE_TRANSFER_WINDOW", transfers.duplicateWindow),
+			rejectDuplicates:     src.choice("DUPLICATE_TRANSFER_MODE", "warn", "warn", "reject") == "reject",
+			idempotencyTTL:       src.duration("IDEMPOTENCY_KEY_TTL", transfers.idempotencyTTL),
+			idempotencyPerCaller: src.choice("IDEMPOTENCY_SCOPE", "wallet", "wallet", "caller") == "caller",
+			acceptZeroTransfers:  src.choice("ZERO_AMOUNT_TRANSFERS", "reject", "reject", "accept") == "accept",
+			initialBalance:       src.amount("INITIAL_BALANCE", transfers.initialBalance),
+			overdraftLimit:       src.amount("OVERDRAFT_LIMIT", transfers.overdraftLimit),
+			baseCurrency:         src.string("BASE_CURRENCY", transfers.baseCurrency),
+			// Комиссия за перевод: фиксированная часть FEE_FLAT и процент от суммы FEE_PERCENT
+			fees: FeePolicy{
+				Flat:    src.amount("FEE_FLAT", transfers.fees.Flat),
+				Percent: src.float("FEE_PERCENT", transfers.fees.Percent),
+			},
+			splitFees: src.choice("FEE_RECORDS", "inline", "inline", "split") == "split",
+		},
+		Handler: handlerConfig{
+			problemJSON:               src.bool("PROBLEM_JSON", handler.problemJSON),
+			maxBatchSize:              src.int("MAX_BATCH_SIZE", handler.maxBatchSize),
+			largeTransactionThreshold: src.amount("LARGE_TRANSACTION_THRESHOLD", handler.largeTransactionThreshold),
+			maxHistoryRows:            src.int("MAX_HISTORY_ROWS", handler.maxHistoryRows),
+			maxExportRows:             src.int("EXPORT_MAX_ROWS", handler.maxExportRows),
+			strictJSON:                src.choice("JSON_PARSING", "strict", "strict", "lenient") == "strict",
+			maxRequestBytes:           src.int64("MAX_REQUEST_BYTES", handler.maxRequestBytes),
+			balanceCacheControl:       src.string("CACHE_CONTROL_BALANCE", handler.balanceCacheControl),
+			historyCacheControl:       src.string("CACHE_CONTROL_HISTORY", handler.historyCacheControl),
+			streamKeepAlive:           src.duration("STREAM_KEEPALIVE_INTERVAL", handler.streamKeepAlive),
+			requestTimeout:            src.duration("REQUEST_TIMEOUT", handler.requestTimeout),
+			exportTimeout:             src.duration("EXPORT_TIMEOUT", handler.exportTimeout),
+			moneyObjects:              src.choice("MONEY_FORMAT", "number", "number", "object") == "object",
+			walletSort: WalletSort{
+				Field: src.choice("WALLET_SORT", handler.walletSort.Field, "id", "balance", "created_at"),
+				Desc:  src.choice("WALLET_SORT_ORDER", "asc", "asc", "desc") == "desc",
+			},
+		},
+		Currencies:        src.list("CURRENCIES"),
+		TransferRateLimit: src.float("TRANSFER_RATE_LIMIT", 10),
+		TransferRateBurst: src.int("TRANSFER_RATE_BURST", 20),
+		MaxResponseBytes:  src.int64("MAX_RESPONSE_BYTES", maxResponseBytes),
+		Auth: AuthConfig{
+			Disabled:  src.bool("AUTH_DISABLED", false),
+			Keys:      src.list("API_KEYS"),
+			AdminKeys: src.list("ADMIN_API_KEYS"),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   src.list("CORS_ALLOWED_ORIGINS"),
+			AllowCredentials: src.bool("CORS_ALLOW_CREDENTIALS", false),
+			AllowedHeaders:   src.list("CORS_ALLOWED_HEADERS"),
+			MaxAge:           src.duration("CORS_MAX_AGE", 10*time.Minute),
+		},
+		Server: ServerConfig{
+			Addr:              src.string("HTTP_ADDR", ":8080"),
+			TLSCertFile:       src.string("TLS_CERT_FILE", ""),
+			TLSKeyFile:        src.string("TLS_KEY_FILE", ""),
+			ReadHeaderTimeout: src.duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+			ReadTimeout:       src.duration("HTTP_READ_TIMEOUT", 10*time.Second),
+			WriteTimeout:      src.duration("HTTP_WRITE_TIMEOUT", 15*time.Second),
+			IdleTimeout:       src.duration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+			ShutdownTimeout:   src.duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		},
+	}
+	switch src.choice("TLS_MIN_VERSION", "1.2", "1.2", "1.3") {
+	case "1.2":
+		cfg.Server.TLSMinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.Server.TLSMinVersion = tls.VersionTLS13
+	}
+
+	if len(src.errs) > 0 {
+		return Config{}, errors.Join(src.errs...)
+	}
+	return cfg, cfg.validate()
+}
+
+// validate проверяет допустимые диапазоны и согласованность параметров и сообщает обо всех нарушениях сразу
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.DB.Port >= 1 && c.DB.Port <= 65535, "invalid DB_PORT %d: must be an integer between 1 and 65535", c.DB.Port)
+	check(c.DB.StatementTimeout >= 0, "invalid DB_STATEMENT_TIMEOUT %s: must be a non-negative duration", c.DB.StatementTimeout)
+	check(c.DB.MaxOpenConns >= 1, "invalid DB_MAX_OPEN_CONNS %d: must be a positive integer", c.DB.MaxOpenConns)
+	check(c.DB.MaxIdleConns >= 0 && c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "invalid DB_MAX_IDLE_CONNS %d: must be between 0 and DB_MAX_OPEN_CONNS", c.DB.MaxIdleConns)
+	check(c.DB.ConnMaxLifetime >= 0, "invalid DB_CONN_MAX_LIFETIME %s: must be a non-negative duration", c.DB.ConnMaxLifetime)
+	check(c.DB.ConnectTimeout > 0, "invalid DB_CONNECT_TIMEOUT %s: must be a positive duration", c.DB.ConnectTimeout)
+	check(c.DB.TxAttempts >= 1, "invalid DB_TX_RETRY_ATTEMPTS %d: must be a positive integer", c.DB.TxAttempts)
+	check(c.DB.ReconcileInterval > 0, "invalid TX_COUNT_RECONCILE_INTERVAL %s: must be a positive duration", c.DB.ReconcileInterval)
+
+	t := c.Transfers
+	check(supportedCurrency(t.baseCurrency), "invalid BASE_CURRENCY: %q", t.baseCurrency)
+	check(t.maxTransfer >= 0, "invalid MAX_TRANSFER %s: must not be negative", t.maxTransfer)
+	check(t.duplicateWindow >= 0, "invalid DUPLICATE_TRANSFER_WINDOW %s: must not be negative", t.duplicateWindow)
+	check(t.idempotencyTTL > 0, "invalid IDEMPOTENCY_KEY_TTL %s: must be a positive duration", t.idempotencyTTL)
+	check(t.initialBalance >= 0, "invalid INITIAL_BALANCE %s: must not be negative", t.initialBalance)
+	check(t.overdraftLimit >= 0, "invalid OVERDRAFT_LIMIT %s: must not be negative", t.overdraftLimit)
+	check(t.fees.Flat >= 0, "invalid FEE_FLAT %s: must not be negative", t.fees.Flat)
+	check(t.fees.Percent >= 0 && t.fees.Percent <= 100, "invalid FEE_PERCENT %v: must be between 0 and 100", t.fees.Percent)
+
+	h := c.Handler
+	check(h.maxBatchSize >= 0, "invalid MAX_BATCH_SIZE %d: must not be negative", h.maxBatchSize)
+	check(h.largeTransactionThreshold >= 0, "invalid LARGE_TRANSACTION_THRESHOLD %s: must not be negative", h.largeTransactionThreshold)
+	check(h.maxHistoryRows >= 1, "invalid MAX_HISTORY_ROWS %d: must be a positive integer", h.maxHistoryRows)
+	check(h.maxExportRows >= 1, "invalid EXPORT_MAX_ROWS %d: must be a positive integer", h.maxExportRows)
+	check(h.maxRequestBytes > 0, "invalid MAX_REQUEST_BYTES %d: must be a positive integer", h.maxRequestBytes)
+	check(h.streamKeepAlive > 0, "invalid STREAM_KEEPALIVE_INTERVAL %s: must be a positive duration", h.streamKeepAlive)
+	check(h.requestTimeout >= 0, "invalid REQUEST_TIMEOUT %s: must not be negative", h.requestTimeout)
+	check(h.exportTimeout >= 0, "invalid EXPORT_TIMEOUT %s: must not be negative", h.exportTimeout)
+	for _, code := range c.Currencies {
+		check(supportedCurrency(code), "invalid CURRENCIES: unsupported currency %q", code)
+	}
+	check(c.TransferRateLimit >= 0, "invalid TRANSFER_RATE_LIMIT %v: must not be negative", c.TransferRateLimit)
+	check(c.TransferRateBurst >= 1, "invalid TRANSFER_RATE_BURST %d: must be a positive integer", c.TransferRateBurst)
+	check(c.MaxResponseBytes >= 0, "invalid MAX_RESPONSE_BYTES %d: must not be negative", c.MaxResponseBytes)
+
+	// Без API-ключей сервис не запускается; AUTH_DISABLED=true отключает проверку для локальной разработки
+	check(c.Auth.Disabled || len(c.Auth.Keys)+len(c.Auth.AdminKeys) > 0, "API_KEYS or ADMIN_API_KEYS must be set unless AUTH_DISABLED=true")
+
+	check(c.CORS.MaxAge >= 0, "invalid CORS_MAX_AGE %s: must not be negative", c.CORS.MaxAge)
+	if _, err := c.CORS.policy(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS: %w", err))
+	}
+
+	s := c.Server
+	check((s.TLSCertFile == "") == (s.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", s.ReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", s.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", s.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", s.IdleTimeout},
+		{"SHUTDOWN_TIMEOUT", s.ShutdownTimeout},
+	} {
+		check(timeout.value >= 0, "invalid %s %s: must not be negative", timeout.name, timeout.value)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envMap возвращает функцию поиска переменных окружения по map вместо окружения процесса
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{"API_KEYS": "key"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if cfg.Store != "postgres" || cfg.DB.Host != "localhost" || cfg.DB.Port != 5432 {
+		t.Errorf("unexpected store defaults: %+v", cfg)
+	}
+	if cfg.DB.MaxOpenConns != 25 || cfg.DB.MaxIdleConns != 10 || cfg.DB.TxAttempts != 3 || !cfg.DB.TransactionsImmutable {
+		t.Errorf("unexpected database defaults: %+v", cfg.DB)
+	}
+	if cfg.Server.Addr != ":8080" || cfg.Server.TLSMinVersion != tls.VersionTLS12 || cfg.Server.ShutdownTimeout != 30*time.Second {
+		t.Errorf("unexpected server defaults: %+v", cfg.Server)
+	}
+	if cfg.Handler != defaultHandlerConfig() {
+		t.Errorf("Handler = %+v, want defaults", cfg.Handler)
+	}
+	if cfg.Transfers.baseCurrency != defaultStoreConfig().baseCurrency {
+		t.Errorf("baseCurrency = %q", cfg.Transfers.baseCurrency)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{
+		"STORE":                   "memory",
+		"DB_PORT":                 "6432",
+		"OVERDRAFT_LIMIT":         "50.00",
+		"FEE_PERCENT":             "1.5",
+		"DUPLICATE_TRANSFER_MODE": "reject",
+		"JSON_PARSING":            "lenient",
+		"REQUEST_TIMEOUT":         "3s",
+		"EXPORT_TIMEOUT":          "2m",
+		"CURRENCIES":              "EUR, GBP",
+		"AUTH_DISABLED":           "true",
+		"CORS_ALLOWED_ORIGINS":    "https://app.example.com",
+		"TLS_MIN_VERSION":         "1.3",
+		"DB_READINESS_QUERY":      "SELECT 1 FROM wallets LIMIT 1",
+	}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if cfg.Store != "memory" || cfg.DB.Port != 6432 || cfg.DB.ReadinessQuery != "SELECT 1 FROM wallets LIMIT 1" {
+		t.Errorf("Store = %q, DB.Port = %d, DB.ReadinessQuery = %q", cfg.Store, cfg.DB.Port, cfg.DB.ReadinessQuery)
+	}
+	if cfg.Transfers.overdraftLimit != 50_00 || cfg.Transfers.fees.Percent != 1.5 || !cfg.Transfers.rejectDuplicates {
+		t.Errorf("unexpected transfer settings: %+v", cfg.Transfers)
+	}
+	if cfg.Handler.strictJSON || cfg.Handler.requestTimeout != 3*time.Second || cfg.Handler.exportTimeout != 2*time.Minute {
+		t.Errorf("unexpected handler settings: %+v", cfg.Handler)
+	}
+	if strings.Join(cfg.Currencies, ",") != "EUR,GBP" {
+		t.Errorf("Currencies = %v", cfg.Currencies)
+	}
+	if cfg.Server.TLSMinVersion != tls.VersionTLS13 {
+		t.Errorf("TLSMinVersion = %x", cfg.Server.TLSMinVersion)
+	}
+	if policy, err := cfg.CORS.policy(); err != nil || policy == nil {
+		t.Errorf("CORS policy = %v, %v", policy, err)
+	}
+}
+
+// Переменная окружения имеет приоритет над файлом, файл — над значением по умолчанию
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `{"DB_HOST": "db", "DB_PORT": 6543, "HTTP_ADDR": ":8443", "AUTH_DISABLED": true}`)
+
+	cfg, err := loadConfig(path, envMap(map[string]string{"DB_HOST": "override"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.DB.Host != "override" || cfg.DB.Port != 6543 || cfg.Server.Addr != ":8443" || !cfg.Auth.Disabled {
+		t.Errorf("unexpected config: host %q, port %d, addr %q, auth disabled %v", cfg.DB.Host, cfg.DB.Port, cfg.Server.Addr, cfg.Auth.Disabled)
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	tests := map[string]string{
+		"malformed":    `{"DB_HOST": `,
+		"invalid key":  `{"db_host": "db"}`,
+		"nested value": `{"DB_HOST": {"name": "db"}}`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadConfig(writeConfigFile(t, content), envMap(nil))
+			if err == nil {
+				t.Fatal("loadConfig succeeded, want error")
+			}
+		})
+	}
+
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"), envMap(nil))
+	if err == nil {
+		t.Error("loadConfig with a missing file succeeded, want error")
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{name: "no API keys", env: map[string]string{}, want: "API_KEYS"},
+		{name: "unparsable port", env: map[string]string{"DB_PORT": "abc"}, want: "DB_PORT"},
+		{name: "port out of range", env: map[string]string{"DB_PORT": "70000"}, want: "DB_PORT"},
+		{name: "idle above open", env: map[string]string{"DB_MAX_OPEN_CONNS": "5", "DB_MAX_IDLE_CONNS": "6"}, want: "DB_MAX_IDLE_CONNS"},
+		{name: "unknown store", env: map[string]string{"STORE": "redis"}, want: "STORE"},
+		{name: "unsupported currency", env: map[string]string{"BASE_CURRENCY": "usd"}, want: "BASE_CURRENCY"},
+		{name: "negative overdraft", env: map[string]string{"OVERDRAFT_LIMIT": "-1"}, want: "OVERDRAFT_LIMIT"},
+		{name: "fee percent above 100", env: map[string]string{"FEE_PERCENT": "101"}, want: "FEE_PERCENT"},
+		{name: "invalid boolean", env: map[string]string{"AUTH_DISABLED": "yes"}, want: "AUTH_DISABLED"},
+		{name: "TLS key without certificate", env: map[string]string{"TLS_KEY_FILE": "key.pem"}, want: "TLS_CERT_FILE"},
+		{name: "export cap", env: map[string]string{"EXPORT_MAX_ROWS": "0"}, want: "EXPORT_MAX_ROWS"},
+		{name: "TLS version", env: map[string]string{"TLS_MIN_VERSION": "1.1"}, want: "TLS_MIN_VERSION"},
+		{name: "wildcard CORS with credentials", env: map[string]string{"CORS_ALLOWED_ORIGINS": "*", "CORS_ALLOW_CREDENTIALS": "true"}, want: "CORS_ALLOWED_ORIGINS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := tt.env["API_KEYS"]; !ok && tt.name != "no API keys" {
+				tt.env["API_KEYS"] = "key"
+			}
+			_, err := loadConfig("", envMap(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("loadConfig error = %v, want mention of %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// Все неверные параметры сообщаются одной ошибкой
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	_, err := loadConfig("", envMap(map[string]string{
+		"API_KEYS":          "key",
+		"DB_MAX_OPEN_CONNS": "0",
+		"MAX_HISTORY_ROWS":  "0",
+	}))
+	if err == nil {
+		t.Fatal("loadConfig succeeded, want error")
+	}
+	for _, key := range []string{"DB_MAX_OPEN_CONNS", "MAX_HISTORY_ROWS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not mention %s", err, key)
+		}
+	}
+}
+
+func TestLoadConfigIdempotencyScope(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{"API_KEYS": "key", "IDEMPOTENCY_SCOPE": "caller"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.Transfers.idempotencyPerCaller {
+		t.Error("IDEMPOTENCY_SCOPE=caller did not scope keys per caller")
+	}
+
+	_, err = loadConfig("", envMap(map[string]string{"API_KEYS": "key", "IDEMPOTENCY_SCOPE": "global"}))
+	if err == nil || !strings.Contains(err.Error(), "IDEMPOTENCY_SCOPE") {
+		t.Errorf("loadConfig error = %v, want mention of IDEMPOTENCY_SCOPE", err)
+	}
+}
+
+func TestLoadConfigWalletSort(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{"API_KEYS": "key", "WALLET_SORT": "balance", "WALLET_SORT_ORDER": "desc"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Handler.walletSort != (WalletSort{Field: "balance", Desc: true}) {
+		t.Errorf("walletSort = %+v", cfg.Handler.walletSort)
+	}
+
+	_, err = loadConfig("", envMap(map[string]string{"API_KEYS": "key", "WALLET_SORT": "id DESC"}))
+	if err == nil || !strings.Contains(err.Error(), "WALLET_SORT") {
+		t.Errorf("loadConfig error = %v, want mention of WALLET_SORT", err)
+	}
+}
+
+func TestLoadConfigFeeRecords(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{"API_KEYS": "key", "FEE_RECORDS": "split"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.Transfers.splitFees {
+		t.Error("FEE_RECORDS=split did not enable separate fee records")
+	}
+}
+
+func TestLoadConfigMoneyFormat(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{"API_KEYS": "key", "MONEY_FORMAT": "object"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.Handler.moneyObjects {
+		t.Error("MONEY_FORMAT=object did not enable money objects")
+	}
+}
+
+func TestLoadConfigZeroAmountTransfers(t *testing.T) {
+	cfg, err := loadConfig("", envMap(map[string]string{"API_KEYS": "key"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Transfers.acceptZeroTransfers {
+		t.Error("zero-amount transfers are accepted by default")
+	}
+
+	cfg, err = loadConfig("", envMap(map[string]string{"API_KEYS": "key", "ZERO_AMOUNT_TRANSFERS": "accept"}))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.Transfers.acceptZeroTransfers {
+		t.Error("ZERO_AMOUNT_TRANSFERS=accept did not accept zero-amount transfers")
+	}
+}
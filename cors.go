@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// corsPolicy описывает, каким источникам браузер разрешает обращаться к API
+type corsPolicy struct {
+	allowedOrigins   map[string]bool
+	allowAnyOrigin   bool
+	allowCredentials bool
+	allowedMethods   []string
+	allowedHeaders   []string
+	// exposedHeaders перечисляет заголовки ответа, доступные скрипту на странице
+	exposedHeaders []string
+	maxAge         time.Duration
+}
+
+// newCORSPolicy создает политику для списка источников; "*" разрешает любой источник,
+// но несовместим с передачей учетных данных
+func newCORSPolicy(origins []string, allowCredentials bool) (*corsPolicy, error) {
+	policy := &corsPolicy{
+		allowedOrigins:   make(map[string]bool),
+		allowCredentials: allowCredentials,
+		allowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		allowedHeaders:   []string{"Content-Type", "Authorization", "Idempotency-Key", "X-Request-Id"},
+		exposedHeaders:   []string{"Content-Range", "Idempotent-Replayed", "Retry-After", "X-Amount-Scale", "X-Request-Id"},
+		maxAge:           10 * time.Minute,
+	}
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+		switch {
+		case origin == "":
+		case origin == "*":
+			policy.allowAnyOrigin = true
+		default:
+			policy.allowedOrigins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	if policy.allowAnyOrigin && allowCredentials {
+		return nil, errors.New("wildcard origin cannot be used with credentials")
+	}
+	if !policy.allowAnyOrigin && len(policy.allowedOrigins) == 0 {
+		return nil, errors.New("no allowed origins")
+	}
+	return policy, nil
+}
+
+func (c *corsPolicy) originAllowed(origin string) bool {
+	return c.allowAnyOrigin || c.allowedOrigins[origin]
+}
+
+// handler добавляет CORS-заголовки к ответам router и отвечает на preflight-запросы.
+// Preflight обрабатывается только для существующих маршрутов и методов, остальные получают обычный 404 или 405.
+func (c *corsPolicy) handler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			router.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && requestMethod != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+			probe := r.Clone(r.Context())
+			probe.Method = requestMethod
+			var match mux.RouteMatch
+			if !router.Match(probe, &match) {
+				router.ServeHTTP(w, r)
+				return
+			}
+			if !c.originAllowed(origin) {
+				responseJSON(w, http.StatusForbidden, map[string]string{"error": "origin not allowed"})
+				return
+			}
+
+			c.setOrigin(w, origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.allowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.allowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if c.originAllowed(origin) {
+			c.setOrigin(w, origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.exposedHeaders, ", "))
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// setOrigin разрешает ответ для origin; с учетными данными браузер требует точный источник вместо "*"
+func (c *corsPolicy) setOrigin(w http.ResponseWriter, origin string) {
+	if c.allowAnyOrigin && !c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
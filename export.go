@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ofxTime форматирует время в формате даты OFX
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000") + "[0:GMT]"
+}
+
+// signedAmount возвращает сумму транзакции со знаком относительно кошелька:
+// входящие переводы положительные, исходящие отрицательные. Комиссия включается
+// в сумму того участника, который ее оплатил, чтобы выписка сходилась с балансом.
+func signedAmount(walletID string, t Transaction) Amount {
+	if t.From == walletID && t.To != walletID {
+		return -t.debit()
+	}
+	if t.From == walletID && t.To == walletID {
+		return 0
+	}
+	return t.credit()
+}
+
+// counterparty возвращает ID второй стороны транзакции
+func counterparty(walletID string, t Transaction) string {
+	if t.From == walletID {
+		return t.To
+	}
+	return t.From
+}
+
+// transactionFITID возвращает идентификатор транзакции для выписки: ее ID в журнале,
+// поэтому повторная выгрузка дает те же FITID и программы учета не дублируют записи
+func transactionFITID(t Transaction) string {
+	return strconv.FormatInt(t.ID, 10)
+}
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxTransaction struct {
+	Type   string `xml:"TRNTYPE"`
+	Posted string `xml:"DTPOSTED"`
+	Amount string `xml:"TRNAMT"`
+	FITID  string `xml:"FITID"`
+	Name   string `xml:"NAME"`
+	Memo   string `xml:"MEMO,omitempty"`
+}
+
+type ofxDocument struct {
+	XMLName xml.Name `xml:"OFX"`
+	Signon  struct {
+		Status   ofxStatus `xml:"STATUS"`
+		Server   string    `xml:"DTSERVER"`
+		Language string    `xml:"LANGUAGE"`
+	} `xml:"SIGNONMSGSRSV1>SONRS"`
+	Statement struct {
+		TrnUID       string           `xml:"TRNUID"`
+		Status       ofxStatus        `xml:"STATUS"`
+		Currency     string           `xml:"STMTRS>CURDEF"`
+		BankID       string           `xml:"STMTRS>BANKACCTFROM>BANKID"`
+		AccountID    string           `xml:"STMTRS>BANKACCTFROM>ACCTID"`
+		AcctType     string           `xml:"STMTRS>BANKACCTFROM>ACCTTYPE"`
+		Start        string           `xml:"STMTRS>BANKTRANLIST>DTSTART"`
+		End          string           `xml:"STMTRS>BANKTRANLIST>DTEND"`
+		Transactions []ofxTransaction `xml:"STMTRS>BANKTRANLIST>STMTTRN"`
+		Balance      string           `xml:"STMTRS>LEDGERBAL>BALAMT"`
+		BalanceAsOf  string           `xml:"STMTRS>LEDGERBAL>DTASOF"`
+	} `xml:"BANKMSGSRSV1>STMTTRNRS"`
+}
+
+// writeOFX записывает историю кошелька в формате OFX 2.2 (XML)
+func writeOFX(w io.Writer, wallet *Wallet, history []Transaction) error {
+	now := time.Now()
+
+	var doc ofxDocument
+	doc.Signon.Status = ofxStatus{Code: 0, Severity: "INFO"}
+	doc.Signon.Server = ofxTime(now)
+	doc.Signon.Language = "ENG"
+	doc.Statement.TrnUID = "0"
+	doc.Statement.Status = ofxStatus{Code: 0, Severity: "INFO"}
+	doc.Statement.Currency = wallet.Currency
+	doc.Statement.BankID = "EWALLET"
+	doc.Statement.AccountID = wallet.ID
+	doc.Statement.AcctType = "CHECKING"
+	doc.Statement.Start = ofxTime(now)
+	doc.Statement.End = ofxTime(now)
+	doc.Statement.Balance = wallet.Balance.String()
+	doc.Statement.BalanceAsOf = ofxTime(now)
+
+	// История отсортирована от новых к старым
+	if len(history) > 0 {
+		doc.Statement.Start = ofxTime(history[len(history)-1].Time)
+		doc.Statement.End = ofxTime(history[0].Time)
+	}
+
+	for _, t := range history {
+		amount := signedAmount(wallet.ID, t)
+		trnType := "CREDIT"
+		if amount < 0 {
+			trnType = "DEBIT"
+		}
+		doc.Statement.Transactions = append(doc.Statement.Transactions, ofxTransaction{
+			Type:   trnType,
+			Posted: ofxTime(t.Time),
+			Amount: amount.String(),
+			FITID:  transactionFITID(t),
+			Name:   counterparty(wallet.ID, t),
+			Memo:   t.Category,
+		})
+	}
+
+	_, err := io.WriteString(w, xml.Header+`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>`+"\n")
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// writeQIF записывает историю кошелька в формате QIF
+func writeQIF(w io.Writer, wallet *Wallet, history []Transaction) error {
+	_, err := io.WriteString(w, "!Type:Bank\n")
+	if err != nil {
+		return err
+	}
+
+	for _, t := range history {
+		_, err := fmt.Fprintf(w, "D%s\nT%s\nP%s\n",
+			t.Time.UTC().Format("01/02/2006"),
+			signedAmount(wallet.ID, t).String(),
+			counterparty(wallet.ID, t))
+		if err != nil {
+			return err
+		}
+		if t.Category != "" {
+			_, err = fmt.Fprintf(w, "L%s\n", t.Category)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = io.WriteString(w, "^\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseOFX разбирает выписку, записанную writeOFX
+func parseOFX(t *testing.T, data []byte) ofxDocument {
+	t.Helper()
+	var doc ofxDocument
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		t.Fatalf("invalid OFX document: %v\n%s", err, data)
+	}
+	return doc
+}
+
+func TestTransactionFITIDUsesID(t *testing.T) {
+	wallet := &Wallet{ID: "a", Currency: "USD"}
+	now := time.Now()
+	// Две транзакции с одинаковыми временем, участниками и суммой различаются только ID
+	history := []Transaction{
+		{ID: 42, Time: now, From: "a", To: "b", Amount: 10_00},
+		{ID: 41, Time: now, From: "a", To: "b", Amount: 10_00},
+	}
+
+	var buf bytes.Buffer
+	err := writeOFX(&buf, wallet, history)
+	if err != nil {
+		t.Fatalf("writeOFX: %v", err)
+	}
+
+	transactions := parseOFX(t, buf.Bytes()).Statement.Transactions
+	if len(transactions) != 2 {
+		t.Fatalf("got %d transactions, want 2", len(transactions))
+	}
+	if transactions[0].FITID != "42" || transactions[1].FITID != "41" {
+		t.Errorf("FITIDs = %q, %q, want 42, 41", transactions[0].FITID, transactions[1].FITID)
+	}
+}
+
+func exportHistory() (*Wallet, []Transaction) {
+	wallet := &Wallet{ID: "a", Balance: 88_50, Currency: "EUR"}
+	day := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	return wallet, []Transaction{
+		{ID: 3, Time: day.Add(48 * time.Hour), From: "a", To: "c", Amount: 10_00, Fee: 50, FeePayer: FeePayerSender, Category: "food"},
+		{ID: 2, Time: day.Add(24 * time.Hour), From: "b", To: "a", Amount: 20_00, Fee: 1_00, FeePayer: FeePayerRecipient},
+		{ID: 1, Time: day, From: "b", To: "a", Amount: 80_00},
+	}
+}
+
+func TestWriteOFX(t *testing.T) {
+	wallet, history := exportHistory()
+	var buf bytes.Buffer
+	err := writeOFX(&buf, wallet, history)
+	if err != nil {
+		t.Fatalf("writeOFX: %v", err)
+	}
+
+	doc := parseOFX(t, buf.Bytes())
+	statement := doc.Statement
+	if statement.Currency != "EUR" || statement.AccountID != "a" || statement.Balance != "88.50" {
+		t.Errorf("statement currency %q, account %q, balance %q", statement.Currency, statement.AccountID, statement.Balance)
+	}
+	if statement.Start != "20240301120000.000[0:GMT]" || statement.End != "20240303120000.000[0:GMT]" {
+		t.Errorf("statement range %s - %s", statement.Start, statement.End)
+	}
+
+	want := []ofxTransaction{
+		{Type: "DEBIT", Posted: "20240303120000.000[0:GMT]", Amount: "-10.50", FITID: "3", Name: "c", Memo: "food"},
+		{Type: "CREDIT", Posted: "20240302120000.000[0:GMT]", Amount: "19.00", FITID: "2", Name: "b"},
+		{Type: "CREDIT", Posted: "20240301120000.000[0:GMT]", Amount: "80.00", FITID: "1", Name: "b"},
+	}
+	if len(statement.Transactions) != len(want) {
+		t.Fatalf("got %d transactions, want %d", len(statement.Transactions), len(want))
+	}
+	for i := range want {
+		if statement.Transactions[i] != want[i] {
+			t.Errorf("transaction %d = %+v, want %+v", i, statement.Transactions[i], want[i])
+		}
+	}
+}
+
+func TestWriteQIF(t *testing.T) {
+	wallet, history := exportHistory()
+	var buf bytes.Buffer
+	err := writeQIF(&buf, wallet, history)
+	if err != nil {
+		t.Fatalf("writeQIF: %v", err)
+	}
+
+	want := "!Type:Bank\n" +
+		"D03/03/2024\nT-10.50\nPc\nLfood\n^\n" +
+		"D03/02/2024\nT19.00\nPb\n^\n" +
+		"D03/01/2024\nT80.00\nPb\n^\n"
+	if buf.String() != want {
+		t.Errorf("QIF export:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+// Выгрузка содержит всю историю одним файлом, даже если она длиннее страницы истории
+func TestExportFullHistory(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+	const transfers = 60
+	for i := 0; i < transfers; i++ {
+		_, err := store.Transfer(context.Background(), from.ID, to.ID, 1_00, TransferOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHTTPHandler(store)
+
+	for _, query := range []string{"?format=ofx", "?format=qif", "?format=ofx&limit=10&offset=5"} {
+		rec := httptest.NewRecorder()
+		h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID+"/history"+query, from.ID, ""))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Range") != "" {
+			t.Fatalf("%s: status = %d, Content-Range %q, want 200 without a range", query, rec.Code, rec.Header().Get("Content-Range"))
+		}
+
+		var got int
+		if strings.Contains(query, "format=ofx") {
+			got = len(parseOFX(t, rec.Body.Bytes()).Statement.Transactions)
+		} else {
+			got = strings.Count(rec.Body.String(), "^\n")
+		}
+		if got != transfers {
+			t.Errorf("%s: exported %d transactions, want %d", query, got, transfers)
+		}
+	}
+}
+
+func TestExportMaxRows(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+	for i := 0; i < 5; i++ {
+		_, err := store.Transfer(context.Background(), from.ID, to.ID, 1_00, TransferOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		maxRows    int
+		query      string
+		wantStatus int
+	}{
+		{maxRows: 4, wantStatus: http.StatusUnprocessableEntity},
+		{maxRows: 5, wantStatus: http.StatusOK},
+		// Фильтр сужает выгрузку до размера, который укладывается в лимит
+		{maxRows: 4, query: "&direction=in", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		h := NewHTTPHandler(store)
+		h.maxExportRows = tt.maxRows
+		for _, format := range []string{"ofx", "qif"} {
+			rec := httptest.NewRecorder()
+			h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID+"/history?format="+format+tt.query, from.ID, ""))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("%s%s with cap %d: status = %d, want %d: %s", format, tt.query, tt.maxRows, rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK && !strings.Contains(decodeBody(t, rec)["error"].(string), "more than 4 transactions") {
+				t.Errorf("%s with cap %d: error %s does not name the limit", format, tt.maxRows, rec.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// Плательщик комиссии за перевод
+const (
+	FeePayerSender    = "sender"
+	FeePayerRecipient = "recipient"
+)
+
+// FeePolicy задает комиссию за перевод как сумму фиксированной части и процента от суммы перевода.
+// Комиссия списывается с участника перевода и не зачисляется ни на один кошелек.
+type FeePolicy struct {
+	Flat    Amount
+	Percent float64
+}
+
+// Fee возвращает комиссию за перевод суммы amount; процентная часть округляется до минимальной единицы.
+// Переводы на нулевую сумму не меняют балансы и проводятся без комиссии.
+func (p FeePolicy) Fee(amount Amount) Amount {
+	if amount == 0 {
+		return 0
+	}
+	return p.Flat + Amount(math.Round(float64(amount)*p.Percent/100))
+}
+
+// apply распределяет комиссию между участниками: возвращает комиссию, сумму списания
+// с отправителя и сумму зачисления получателю
+func (p FeePolicy) apply(amount Amount, payer string) (fee, debit, credit Amount) {
+	fee = p.Fee(amount)
+	if payer == FeePayerRecipient {
+		return fee, amount, amount - fee
+	}
+	return fee, amount + fee, amount
+}
+
+// records возвращает строки журнала для перевода t. При splitFees перевод с комиссией
+// записывается двумя строками с общим GroupID: сам перевод без комиссии и запись комиссии
+// на нулевую сумму с тем же плательщиком. Изменения балансов по двум строкам в сумме
+// совпадают с изменениями по одной, поэтому debit, credit и balanceDeltaSQL их не различают.
+func (c storeConfig) records(t Transaction) []Transaction {
+	if !c.splitFees || t.Fee == 0 {
+		return []Transaction{t}
+	}
+	t.GroupID = uuid.New().String()
+	principal, fee := t, t
+	principal.Fee = 0
+	fee.Amount = 0
+	return []Transaction{principal, fee}
+}
+
+// feeRecordSQL отбирает отдельные записи комиссии, которые не считаются переводами в статистике кошелька
+const feeRecordSQL = `(group_id IS NOT NULL AND amount = 0)`
+
+// validFeePayer проверяет плательщика комиссии; пустое значение означает отправителя
+func validFeePayer(payer string) bool {
+	return payer == "" || payer == FeePayerSender || payer == FeePayerRecipient
+}
+
+// debit возвращает сумму, списанную транзакцией с отправителя
+func (t Transaction) debit() Amount {
+	if t.FeePayer == FeePayerRecipient {
+		return t.Amount
+	}
+	return t.Amount + t.Fee
+}
+
+// credit возвращает сумму, зачисленную транзакцией получателю
+func (t Transaction) credit() Amount {
+	if t.FeePayer == FeePayerRecipient {
+		return t.Amount - t.Fee
+	}
+	return t.Amount
+}
+
+// balanceDeltaSQL вычисляет изменение баланса кошелька $1 транзакцией с учетом комиссии
+const balanceDeltaSQL = `CASE WHEN to_wallet = $1 THEN amount - CASE WHEN fee_payer = 'recipient' THEN fee ELSE 0 END ELSE 0 END
+		- CASE WHEN from_wallet = $1 THEN amount + CASE WHEN fee_payer = 'sender' THEN fee ELSE 0 END ELSE 0 END`
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout ограничивает время проверки базы данных, чтобы балансировщик не ждал зависший пинг
+const readinessTimeout = 2 * time.Second
+
+// HealthCheck представляет результат проверки одной зависимости сервиса
+type HealthCheck struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Ping проверяет доступность базы данных и, если задан контрольный запрос, что он выполняется:
+// например, SELECT 1 FROM wallets LIMIT 1 не проходит, пока схема не применена
+func (s *DBStore) Ping(ctx context.Context) error {
+	err := s.db.PingContext(ctx)
+	if err != nil || s.readinessQuery == "" {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.readinessQuery)
+	return err
+}
+
+// HealthzHandler обрабатывает проверку живости: процесс отвечает на запросы
+func (h *HTTPHandler) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	responseJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler обрабатывает проверку готовности: сервис может обслуживать запросы, пока доступна база данных
+func (h *HTTPHandler) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	started := time.Now()
+	err := h.store.Ping(ctx)
+	check := HealthCheck{
+		Name:      "database",
+		Status:    "ok",
+		LatencyMs: float64(time.Since(started).Microseconds()) / 1000,
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		check.Status = "unavailable"
+		check.Error = err.Error()
+	}
+
+	responseJSON(w, status, map[string]any{
+		"status": check.Status,
+		"checks": []HealthCheck{check},
+	})
+}
@@ -1,248 +1,3399 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	// База часовых поясов встроена, чтобы ?tz= работал в образах без tzdata
+	_ "time/tzdata"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"golang.org/x/time/rate"
 )
 
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "root"
-	password = ""
-	dbname   = "admindb"
-)
+//go:embed schema.sql
+var schema string
 
 // Wallet представляет состояние кошелька
 type Wallet struct {
-	ID      string  `json:"id"`
-	Balance float64 `json:"balance"`
+	ID      string `json:"id"`
+	Balance Amount `json:"balance"`
+	// Currency задается кодом ISO 4217 при создании кошелька
+	Currency string `json:"currency"`
+	// Version увеличивается при каждом изменении баланса и используется для обнаружения потерянных обновлений
+	Version int `json:"version"`
+	// Active становится false после деактивации кошелька
+	Active bool `json:"active"`
+}
+
+// WalletPage представляет страницу списка кошельков с общим количеством кошельков
+type WalletPage struct {
+	Wallets []Wallet `json:"wallets"`
+	Total   int64    `json:"total"`
+}
+
+// WalletSort задает порядок списка кошельков: поле из walletSortColumns и направление
+type WalletSort struct {
+	Field string
+	Desc  bool
+}
+
+// walletSortColumns перечисляет поля, по которым разрешена сортировка списка кошельков, и их столбцы.
+// В запрос подставляются только значения из этого списка.
+var walletSortColumns = map[string]string{
+	"id":         "id",
+	"balance":    "balance",
+	"created_at": "created_at",
+}
+
+// orderBy возвращает выражение ORDER BY; при равных значениях поля кошельки упорядочиваются по ID,
+// чтобы страницы не пересекались
+func (s WalletSort) orderBy() (string, error) {
+	column, ok := walletSortColumns[s.Field]
+	if !ok {
+		return "", fmt.Errorf("invalid sort field %q", s.Field)
+	}
+	direction := "ASC"
+	if s.Desc {
+		direction = "DESC"
+	}
+	if column == "id" {
+		return "id " + direction, nil
+	}
+	return column + " " + direction + ", id " + direction, nil
 }
 
 // Transaction представляет информацию о транзакции
 type Transaction struct {
+	ID     int64     `json:"id"`
 	Time   time.Time `json:"time"`
 	From   string    `json:"from"`
 	To     string    `json:"to"`
-	Amount float64   `json:"amount"`
+	Amount Amount    `json:"amount"`
+	// Fee содержит комиссию за перевод, FeePayer — кто из участников ее оплатил
+	Fee      Amount `json:"fee"`
+	FeePayer string `json:"fee_payer"`
+	// Category назначается правилами категоризации при создании транзакции
+	Category string `json:"category,omitempty"`
+	// ReceiptRef ссылается на приложенный к переводу чек: URL или ключ объекта в хранилище
+	ReceiptRef string `json:"receipt_ref,omitempty"`
+	// GroupID связывает перевод с отдельной записью его комиссии, см. storeConfig.records
+	GroupID string `json:"group_id,omitempty"`
+}
+
+// CategoryRule описывает правило автоматической категоризации транзакций.
+// Пустое поле From или To совпадает с любым кошельком.
+type CategoryRule struct {
+	ID       int    `json:"id"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Category string `json:"category"`
+}
+
+// BalancePoint представляет баланс кошелька на конец временного интервала
+type BalancePoint struct {
+	Time    time.Time `json:"time"`
+	Balance Amount    `json:"balance"`
+}
+
+// Recipient представляет получателя переводов кошелька с их количеством и общей суммой
+type Recipient struct {
+	WalletID string `json:"wallet_id"`
+	Count    int64  `json:"count"`
+	Total    Amount `json:"total"`
+}
+
+// CounterpartyCount представляет количество транзакций кошелька с одним контрагентом в обе стороны
+type CounterpartyCount struct {
+	WalletID string `json:"wallet_id"`
+	Sent     int64  `json:"sent"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+}
+
+// BalanceReplayStep представляет баланс кошелька после одной транзакции при пересчете
+type BalanceReplayStep struct {
+	TransactionID int64     `json:"transaction_id"`
+	Time          time.Time `json:"time"`
+	Delta         Amount    `json:"delta"`
+	Balance       Amount    `json:"balance"`
+}
+
+// BalanceReplay представляет пересчет баланса кошелька по истории транзакций.
+// Промежуточные балансы не хранятся, поэтому с сохраненным сравнивается только итоговый,
+// а внутри истории обнаруживается лишь невозможный для переводов баланс ниже -overdraftLimit.
+type BalanceReplay struct {
+	WalletID        string              `json:"wallet_id"`
+	InitialBalance  Amount              `json:"initial_balance"`
+	Steps           []BalanceReplayStep `json:"steps"`
+	ComputedBalance Amount              `json:"computed_balance"`
+	StoredBalance   Amount              `json:"stored_balance"`
+	Consistent      bool                `json:"consistent"`
+	// Divergence равна разнице сохраненного и пересчитанного балансов
+	Divergence Amount `json:"divergence"`
+	// FirstDivergence указывает первый шаг, после которого пересчитанный баланс опустился ниже
+	// -overdraftLimit. Перевод такого не допускает, поэтому история до этого шага уже расходится с балансом.
+	FirstDivergence *BalanceReplayStep `json:"first_divergence,omitempty"`
+}
+
+// MonthlyBalance представляет баланс кошелька на начало месяца
+type MonthlyBalance struct {
+	Month   string `json:"month"`
+	Opening Amount `json:"opening_balance"`
+}
+
+// Velocity представляет количество и сумму транзакций кошелька за последнее окно времени
+type Velocity struct {
+	Window string `json:"window"`
+	Count  int64  `json:"count"`
+	Total  Amount `json:"total"`
+}
+
+// BalanceBucket представляет количество кошельков с балансом в диапазоне [From, To)
+type BalanceBucket struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Count int64   `json:"count"`
+}
+
+// CurrencyTotal представляет количество кошельков в валюте и сумму их балансов
+type CurrencyTotal struct {
+	Currency     string `json:"currency"`
+	WalletCount  int64  `json:"wallet_count"`
+	TotalBalance Amount `json:"total_balance"`
+}
+
+// Stats представляет сводные показатели по всем кошелькам и транзакциям для сверки.
+// Комиссии списываются с кошельков, не зачисляясь никуда, поэтому при переводах
+// сумма балансов и собранных комиссий равна сумме начальных балансов.
+type Stats struct {
+	WalletCount         int64  `json:"wallet_count"`
+	TotalBalance        Amount `json:"total_balance"`
+	TotalInitialBalance Amount `json:"total_initial_balance"`
+	TransactionCount    int64  `json:"transaction_count"`
+	TransferVolume      Amount `json:"transfer_volume"`
+	FeesCollected       Amount `json:"fees_collected"`
+}
+
+// AuditEntry представляет запись журнала аудита об изменяющем запросе
+type AuditEntry struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Caller   string    `json:"caller"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	WalletID string    `json:"wallet_id,omitempty"`
+	Status   int       `json:"status"`
+}
+
+// ErrInvalidInterval возвращается при неподдерживаемом интервале временного ряда
+var ErrInvalidInterval = errors.New("invalid interval")
+
+// seriesIntervals перечисляет интервалы, допустимые для date_trunc
+var seriesIntervals = map[string]bool{
+	"hour":  true,
+	"day":   true,
+	"week":  true,
+	"month": true,
+}
+
+// SweepConfig задает автоматический вывод баланса сверх порога на целевой кошелек
+type SweepConfig struct {
+	WalletID  string `json:"wallet_id"`
+	Threshold Amount `json:"threshold"`
+	Target    string `json:"target"`
+}
+
+// HistoryFilter ограничивает выборку истории направлением и интервалом времени [From, To).
+// Пустое направление означает все транзакции, нулевое время — отсутствие границы.
+type HistoryFilter struct {
+	// Direction принимает значения in (входящие), out (исходящие) или all
+	Direction string
+	From      time.Time
+	To        time.Time
+}
+
+// TransferOptions задает дополнительные параметры перевода
+type TransferOptions struct {
+	// CreateRecipient создает кошелек получателя с нулевым балансом, если его еще нет
+	CreateRecipient bool
+	// ReceiptRef сохраняется в транзакции как ссылка на чек
+	ReceiptRef string
+	// IdempotencyKey защищает от повторного проведения перевода: повторный запрос с тем же ключом
+	// в той же области (отправитель или вызывающий) возвращает сохраненный результат без движения средств
+	IdempotencyKey string
+	// Caller идентифицирует вызывающего, если ключи идемпотентности действуют в пределах вызывающего
+	Caller string
+	// FeePayer определяет, кто оплачивает комиссию: sender (по умолчанию) или recipient
+	FeePayer string
+}
+
+// TransferItem описывает один перевод пакета
+type TransferItem struct {
+	To     string `json:"to"`
+	Amount Amount `json:"amount"`
+}
+
+// objectKeyPattern описывает допустимый ключ объекта в хранилище
+var objectKeyPattern = regexp.MustCompile(`^[A-Za-z0-9!_.*'()/-]+$`)
+
+// validReceiptRef проверяет, что ссылка на чек является http(s) URL или ключом объекта
+func validReceiptRef(ref string) bool {
+	if len(ref) > 1024 {
+		return false
+	}
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		u, err := url.Parse(ref)
+		return err == nil && u.Host != ""
+	}
+	return objectKeyPattern.MatchString(ref)
+}
+
+// TransferResult представляет результат перевода для отправителя
+type TransferResult struct {
+	Message string `json:"message"`
+	// Amount, Fee и TotalDebited раскладывают перевод: сумма без комиссии, комиссия и списанная
+	// с отправителя сумма, которая включает комиссию, если ее оплачивает отправитель
+	Amount       Amount `json:"amount"`
+	Fee          Amount `json:"fee"`
+	TotalDebited Amount `json:"total_debited"`
+	// BalanceBefore и BalanceAfter считываются под блокировкой внутри транзакции перевода
+	BalanceBefore Amount `json:"balance_before"`
+	BalanceAfter  Amount `json:"balance_after"`
+	// RecipientBalanceAfter считывается в той же транзакции после всех обновлений
+	RecipientBalanceAfter Amount `json:"recipient_balance_after"`
+	// DuplicateWarning выставляется, если такой же перевод уже был в окне обнаружения дубликатов
+	DuplicateWarning bool `json:"duplicate_warning,omitempty"`
+	// ProcessingTimeMs измеряется обработчиком от получения запроса до отправки ответа
+	ProcessingTimeMs float64 `json:"processing_time_ms"`
+	// Transaction содержит созданную транзакцию с присвоенными сервером ID и временем
+	Transaction *Transaction `json:"transaction"`
+	// FeeTransaction содержит отдельную запись комиссии, если комиссия учитывается отдельно от перевода
+	FeeTransaction *Transaction `json:"fee_transaction,omitempty"`
+	// Replayed означает, что результат взят из ранее проведенного перевода с тем же ключом идемпотентности
+	Replayed bool `json:"-"`
+}
+
+// ErrDuplicateTransfer возвращается, если такой же перевод уже был проведен в окне обнаружения дубликатов
+var ErrDuplicateTransfer = errors.New("duplicate transfer")
+
+// ErrWalletExists возвращается при попытке создать кошелек с уже существующим ID
+var ErrWalletExists = errors.New("wallet already exists")
+
+// ErrInvalidAmount возвращается для нулевой, отрицательной или нечисловой суммы перевода
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ErrSelfTransfer возвращается при попытке перевести средства на тот же кошелек
+var ErrSelfTransfer = errors.New("cannot transfer to the same wallet")
+
+// ErrInvalidReceiptRef возвращается для ссылки на чек недопустимого формата
+var ErrInvalidReceiptRef = errors.New("invalid receipt_ref: must be an http(s) URL or an object key")
+
+// ErrWalletNotFound возвращается, если кошелек с указанным ID не существует
+var ErrWalletNotFound = errors.New("wallet not found")
+
+// ErrRecipientNotFound возвращается, если кошелек получателя перевода не существует
+var ErrRecipientNotFound = errors.New("recipient wallet not found")
+
+// ErrInsufficientFunds возвращается, если на балансе отправителя недостаточно средств
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// ErrSweepNotConfigured возвращается, если для кошелька не настроен автоматический вывод
+var ErrSweepNotConfigured = errors.New("sweep not configured")
+
+// ErrAmountTooLarge возвращается, если сумма перевода превышает допустимый максимум
+var ErrAmountTooLarge = errors.New("amount too large")
+
+// ErrEmptyBatch возвращается, если пакетный перевод не содержит ни одного перевода
+var ErrEmptyBatch = errors.New("empty batch")
+
+// ErrVersionConflict возвращается, если кошелек изменился после чтения ожидаемой версии
+var ErrVersionConflict = errors.New("wallet was modified concurrently")
+
+// ErrWalletInactive возвращается при переводе с деактивированного кошелька или на него
+var ErrWalletInactive = errors.New("wallet is deactivated")
+
+// ErrNonZeroBalance возвращается при деактивации кошелька, на котором остались средства
+var ErrNonZeroBalance = errors.New("wallet balance is not zero: transfer the funds out or use force=true")
+
+// ErrCurrencyMismatch возвращается при попытке перевода между кошельками в разных валютах
+var ErrCurrencyMismatch = errors.New("currency mismatch: wallets must have the same currency")
+
+// ErrInvalidFeePayer возвращается для неизвестного плательщика комиссии
+var ErrInvalidFeePayer = errors.New("invalid fee_payer: must be sender or recipient")
+
+// ErrFeeExceedsAmount возвращается, если комиссия, оплачиваемая получателем, больше суммы перевода
+var ErrFeeExceedsAmount = errors.New("fee exceeds transfer amount")
+
+// ErrAmountPrecision возвращается, если в сумме больше знаков после запятой, чем допускает валюта кошелька
+var ErrAmountPrecision = errors.New("invalid amount precision")
+
+// currencyPattern описывает формат кода валюты ISO 4217
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Store описывает хранилище кошельков, от которого зависят основные обработчики.
+// Реализуется DBStore для PostgreSQL и MemStore для запуска без базы данных.
+type Store interface {
+	CreateWallet(ctx context.Context, currency string) (*Wallet, error)
+	GetWallet(ctx context.Context, walletID string) (*Wallet, error)
+	Transfer(ctx context.Context, fromID, toID string, amount Amount, opts TransferOptions) (*TransferResult, error)
+	GetHistory(ctx context.Context, walletID string, filter HistoryFilter, limit, offset int) ([]Transaction, error)
+	Ping(ctx context.Context) error
+}
+
+// storeConfig содержит настройки кошельков и переводов, общие для всех реализаций Store
+type storeConfig struct {
+	// maxTransfer ограничивает сумму одного перевода, 0 отключает ограничение
+	maxTransfer Amount
+	// autoCreateRecipient создает отсутствующих получателей при любом переводе
+	autoCreateRecipient bool
+	// duplicateWindow задает окно, в котором перевод с теми же отправителем, получателем и суммой
+	// считается дубликатом, 0 отключает проверку
+	duplicateWindow time.Duration
+	// rejectDuplicates отклоняет дубликаты вместо предупреждения в ответе
+	rejectDuplicates bool
+	// idempotencyTTL задает срок хранения ключей идемпотентности
+	idempotencyTTL time.Duration
+	// idempotencyPerCaller делает ключи идемпотентности уникальными в пределах вызывающего,
+	// а не кошелька отправителя
+	idempotencyPerCaller bool
+	// acceptZeroTransfers разрешает переводы на нулевую сумму: они записываются в историю
+	// (например, для проверки получателя), но не меняют балансы
+	acceptZeroTransfers bool
+	// initialBalance задает баланс нового кошелька
+	initialBalance Amount
+	// overdraftLimit задает, насколько баланс отправителя может уйти в минус, 0 запрещает овердрафт
+	overdraftLimit Amount
+	// baseCurrency назначается кошелькам, для которых валюта не указана
+	baseCurrency string
+	// fees задает комиссию за переводы, нулевая политика означает переводы без комиссии
+	fees FeePolicy
+	// splitFees записывает комиссию отдельной транзакцией, связанной с переводом общим GroupID
+	splitFees bool
+}
+
+// defaultStoreConfig возвращает настройки по умолчанию
+func defaultStoreConfig() storeConfig {
+	return storeConfig{
+		idempotencyTTL: 24 * time.Hour,
+		baseCurrency:   "USD",
+	}
+}
+
+// idempotencyScope возвращает область, в пределах которой уникален ключ идемпотентности перевода.
+// Область хранится вместе с ключом, поэтому ключи разных областей не пересекаются.
+func (c storeConfig) idempotencyScope(fromID string, opts TransferOptions) string {
+	if c.idempotencyPerCaller {
+		return "caller:" + opts.Caller
+	}
+	return "wallet:" + fromID
+}
+
+// validateTransfer проверяет параметры перевода до обращения к хранилищу,
+// чтобы проверки действовали для любого вызывающего кода и любой реализации Store
+func (c storeConfig) validateTransfer(fromID, toID string, amount Amount, opts TransferOptions) error {
+	if amount < 0 || (amount == 0 && !c.acceptZeroTransfers) {
+		return ErrInvalidAmount
+	}
+	if fromID == toID {
+		return ErrSelfTransfer
+	}
+	if opts.ReceiptRef != "" && !validReceiptRef(opts.ReceiptRef) {
+		return ErrInvalidReceiptRef
+	}
+	if c.maxTransfer > 0 && amount > c.maxTransfer {
+		return ErrAmountTooLarge
+	}
+	if !validFeePayer(opts.FeePayer) {
+		return ErrInvalidFeePayer
+	}
+	if _, _, credit := c.fees.apply(amount, opts.FeePayer); credit < 0 {
+		return ErrFeeExceedsAmount
+	}
+	return nil
 }
 
 type DBStore struct {
 	db *sql.DB
+	storeConfig
+	// txAttempts ограничивает число попыток выполнить транзакцию перевода при конфликте сериализации
+	txAttempts int
+	// readinessQuery дополняет пинг проверки готовности контрольным запросом, пустая строка отключает его
+	readinessQuery string
 }
 
 // NewDBStore создает новый экземпляр DBStore
 func NewDBStore(db *sql.DB) *DBStore {
 	return &DBStore{
-		db: db,
+		db:          db,
+		storeConfig: defaultStoreConfig(),
+		txAttempts:  3,
 	}
 }
 
-// CreateWallet создает новый кошелек в базе данных
-func (s *DBStore) CreateWallet() (*Wallet, error) {
+// CreateWallet создает новый кошелек в базе данных в указанной валюте, пустая строка означает базовую валюту
+func (s *DBStore) CreateWallet(ctx context.Context, currency string) (*Wallet, error) {
 	id := uuid.New().String()
-	balance := 100.0
+	balance := s.initialBalance
+	if currency == "" {
+		currency = s.baseCurrency
+	}
 
-	_, err := s.db.Exec("INSERT INTO wallets (id, balance) VALUES ($1, $2)", id, balance)
+	_, err := s.db.ExecContext(ctx, "INSERT INTO wallets (id, balance, initial_balance, currency) VALUES ($1, $2, $2, $3)", id, balance, currency)
+	if isUniqueViolation(err) {
+		return nil, ErrWalletExists
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &Wallet{
-		ID:      id,
-		Balance: balance,
+		ID:       id,
+		Balance:  balance,
+		Currency: currency,
+		Active:   true,
 	}, nil
 }
 
 // GetWallet возвращает кошелек из базы данных по его ID
-func (s *DBStore) GetWallet(walletID string) (*Wallet, error) {
+func (s *DBStore) GetWallet(ctx context.Context, walletID string) (*Wallet, error) {
 	var wallet Wallet
-	err := s.db.QueryRow("SELECT id, balance FROM wallets WHERE id = $1", walletID).Scan(&wallet.ID, &wallet.Balance)
+	err := s.db.QueryRowContext(ctx, "SELECT id, balance, currency, version, active FROM wallets WHERE id = $1", walletID).
+		Scan(&wallet.ID, &wallet.Balance, &wallet.Currency, &wallet.Version, &wallet.Active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &wallet, nil
 }
 
-// Transfer осуществляет перевод средств между кошельками в базе данных
-func (s *DBStore) Transfer(fromID, toID string, amount float64) error {
-	tx, err := s.db.Begin()
+// ListWallets возвращает страницу кошельков в порядке sort и общее количество кошельков
+func (s *DBStore) ListWallets(ctx context.Context, sort WalletSort, limit, offset int) (*WalletPage, error) {
+	orderBy, err := sort.orderBy()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tx.Rollback()
 
-	// Проверка баланса отправителя
-	var fromBalance float64
-	err = tx.QueryRow("SELECT balance FROM wallets WHERE id = $1 FOR UPDATE", fromID).Scan(&fromBalance)
+	// Страница и общее количество читаются из одного снимка
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	if fromBalance < amount {
-		return fmt.Errorf("insufficient funds")
+	page := &WalletPage{Wallets: []Wallet{}}
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM wallets").Scan(&page.Total)
+	if err != nil {
+		return nil, err
 	}
 
-	// Обновление баланса отправителя
-	_, err = tx.Exec("UPDATE wallets SET balance = balance - $1 WHERE id = $2", amount, fromID)
+	rows, err := tx.QueryContext(ctx, "SELECT id, balance, currency, version, active FROM wallets ORDER BY "+orderBy+" LIMIT $1 OFFSET $2", limit, offset)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Обновление баланса получателя
-	_, err = tx.Exec("UPDATE wallets SET balance = balance + $1 WHERE id = $2", amount, toID)
+	for rows.Next() {
+		var wallet Wallet
+		err := rows.Scan(&wallet.ID, &wallet.Balance, &wallet.Currency, &wallet.Version, &wallet.Active)
+		if err != nil {
+			return nil, err
+		}
+		page.Wallets = append(page.Wallets, wallet)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// DeactivateWallet деактивирует кошелек, сохраняя его историю. Кошелек с ненулевым балансом
+// деактивируется только при force, средства на нем при этом замораживаются.
+func (s *DBStore) DeactivateWallet(ctx context.Context, walletID string, force bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec("INSERT INTO transactions (from_wallet, to_wallet, amount) VALUES ($1, $2, $3)", fromID, toID, amount)
+	// Блокировка не дает переводу изменить баланс между проверкой и деактивацией
+	var balance Amount
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM wallets WHERE id = $1 FOR UPDATE", walletID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrWalletNotFound
+	}
 	if err != nil {
 		return err
 	}
+	if balance != 0 && !force {
+		return ErrNonZeroBalance
+	}
 
-	err = tx.Commit()
+	_, err = tx.ExecContext(ctx, "UPDATE wallets SET active = false WHERE id = $1", walletID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
+}
+
+// UpdateWalletBalance изменяет баланс кошелька на delta, только если его версия все еще равна expectedVersion.
+// Позволяет обновлять баланс по принципу compare-and-set, не удерживая блокировку строки на время запроса.
+// Деактивированный кошелек не меняется, а баланс не может опуститься ниже -overdraftLimit, как и при переводе.
+//
+// Изменение не записывается в журнал транзакций: это прямая корректировка баланса в обход журнала,
+// поэтому после нее ReplayBalance покажет расхождение с историей на величину delta.
+func (s *DBStore) UpdateWalletBalance(ctx context.Context, walletID string, expectedVersion int, delta Amount) (*Wallet, error) {
+	var wallet Wallet
+	err := s.db.QueryRowContext(ctx, `UPDATE wallets SET balance = balance + $3, version = version + 1
+		WHERE id = $1 AND version = $2 AND active AND balance + $3 >= -$4
+		RETURNING id, balance, currency, version, active`, walletID, expectedVersion, delta, s.overdraftLimit).
+		Scan(&wallet.ID, &wallet.Balance, &wallet.Currency, &wallet.Version, &wallet.Active)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Ни одна строка не обновлена: выясняем, какое из условий не выполнено
+		current, err := s.GetWallet(ctx, walletID)
+		switch {
+		case err != nil:
+			return nil, err
+		case current.Version != expectedVersion:
+			return nil, ErrVersionConflict
+		case !current.Active:
+			return nil, ErrWalletInactive
+		default:
+			return nil, ErrInsufficientFunds
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wallet, nil
 }
 
-// GetHistory возвращает историю транзакций для указанного кошелька из базы данных
-func (s *DBStore) GetHistory(walletID string) ([]Transaction, error) {
-	rows, err := s.db.Query("SELECT time, from_wallet, to_wallet, amount FROM transactions WHERE from_wallet = $1 OR to_wallet = $1", walletID)
+// Transfer осуществляет перевод средств между кошельками в базе данных
+func (s *DBStore) Transfer(ctx context.Context, fromID, toID string, amount Amount, opts TransferOptions) (*TransferResult, error) {
+	err := s.validateTransfer(fromID, toID, amount, opts)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	if opts.FeePayer == "" {
+		opts.FeePayer = FeePayerSender
+	}
 
-	var history []Transaction
-	for rows.Next() {
-		var transaction Transaction
-		err := rows.Scan(&transaction.Time, &transaction.From, &transaction.To, &transaction.Amount)
+	var result *TransferResult
+	err = s.withTxRetry(ctx, nil, func(tx *sql.Tx) error {
+		var err error
+		result, err = s.transferTx(ctx, tx, fromID, toID, amount, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// transferTx проводит проверенный перевод в транзакции tx; фиксирует транзакцию вызывающий код
+func (s *DBStore) transferTx(ctx context.Context, tx *sql.Tx, fromID, toID string, amount Amount, opts TransferOptions) (*TransferResult, error) {
+	fee, debit, credit := s.fees.apply(amount, opts.FeePayer)
+
+	scope := s.idempotencyScope(fromID, opts)
+	if opts.IdempotencyKey != "" {
+		replayed, err := s.claimIdempotencyKey(ctx, tx, scope, opts.IdempotencyKey)
+		if err != nil || replayed != nil {
+			return replayed, err
+		}
+	}
+
+	// Оба участника и целевой кошелек вывода излишка получателя блокируются до любых изменений
+	var sweeps map[string]SweepConfig
+	if credit > 0 {
+		var err error
+		sweeps, err = sweepsFor(ctx, tx, toID)
 		if err != nil {
 			return nil, err
 		}
-		history = append(history, transaction)
+	}
+	err := lockWallets(ctx, tx, append([]string{fromID, toID}, sweepTargets(sweeps)...)...)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := rows.Err(); err != nil {
+	// Проверка баланса отправителя
+	var fromBalance Amount
+	var currency string
+	var active bool
+	err = tx.QueryRowContext(ctx, "SELECT balance, currency, active FROM wallets WHERE id = $1", fromID).Scan(&fromBalance, &currency, &active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, ErrWalletInactive
+	}
+	if err := amount.checkPrecision(currency); err != nil {
 		return nil, err
 	}
 
-	return history, nil
-}
+	// Оплачиваемая отправителем комиссия списывается вместе с суммой перевода
+	if fromBalance+s.overdraftLimit < debit {
+		return nil, ErrInsufficientFunds
+	}
 
-type HTTPHandler struct {
-	store *DBStore
-}
+	// Поиск дубликатов выполняется под блокировкой отправителя, поэтому одновременные
+	// одинаковые переводы не проходят проверку оба
+	var duplicate bool
+	if s.duplicateWindow > 0 {
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM transactions
+			WHERE from_wallet = $1 AND to_wallet = $2 AND amount = $3 AND time >= now() - $4 * interval '1 second')`,
+			fromID, toID, amount, s.duplicateWindow.Seconds()).Scan(&duplicate)
+		if err != nil {
+			return nil, err
+		}
+		if duplicate && s.rejectDuplicates {
+			return nil, ErrDuplicateTransfer
+		}
+	}
 
-func NewHTTPHandler(store *DBStore) *HTTPHandler {
-	return &HTTPHandler{
-		store: store,
+	// Создание получателя внутри той же транзакции в валюте отправителя; при одновременном
+	// создании ON CONFLICT дожидается конкурирующей вставки и не создает дубликат
+	if opts.CreateRecipient || s.autoCreateRecipient {
+		_, err = tx.ExecContext(ctx, "INSERT INTO wallets (id, balance, currency) VALUES ($1, 0, $2) ON CONFLICT (id) DO NOTHING", toID, currency)
+		if err != nil {
+			return nil, err
+		}
 	}
-}
 
-// CreateWalletHandler обрабатывает запрос на создание нового кошелька
-func (h *HTTPHandler) CreateWalletHandler(w http.ResponseWriter, r *http.Request) {
-	wallet, err := h.store.CreateWallet()
+	err = checkRecipient(ctx, tx, toID, currency)
 	if err != nil {
-		responseJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create wallet"})
-		return
+		return nil, err
 	}
-	responseJSON(w, http.StatusOK, wallet)
-}
 
-// TransferHandler обрабатывает запрос на перевод средств между кошельками
-func (h *HTTPHandler) TransferHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	fromID := vars["walletId"]
+	// Обновление баланса отправителя
+	_, err = tx.ExecContext(ctx, "UPDATE wallets SET balance = balance - $1, version = version + 1 WHERE id = $2", debit, fromID)
+	if err != nil {
+		return nil, err
+	}
 
-	var request struct {
-		To     string  `json:"to"`
-		Amount float64 `json:"amount"`
+	// Обновление баланса получателя
+	res, err := tx.ExecContext(ctx, "UPDATE wallets SET balance = balance + $1, version = version + 1 WHERE id = $2", credit, toID)
+	if err != nil {
+		return nil, err
+	}
+	credited, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if credited == 0 {
+		return nil, ErrRecipientNotFound
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&request)
+	category, err := matchCategory(ctx, tx, fromID, toID)
 	if err != nil {
-		responseJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request"})
-		return
+		return nil, err
 	}
 
-	err = h.store.Transfer(fromID, request.To, request.Amount)
+	records := s.records(Transaction{
+		From:       fromID,
+		To:         toID,
+		Amount:     amount,
+		Fee:        fee,
+		FeePayer:   opts.FeePayer,
+		Category:   category.String,
+		ReceiptRef: opts.ReceiptRef,
+	})
+	err = insertTransactions(ctx, tx, records)
 	if err != nil {
-		responseJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-		return
+		return nil, err
 	}
 
-	responseJSON(w, http.StatusOK, map[string]string{"message": "transfer successful"})
-}
+	// Обновление счетчиков транзакций обоих участников
+	_, err = tx.ExecContext(ctx, "UPDATE wallets SET transaction_count = transaction_count + $1 WHERE id IN ($2, $3)", len(records), fromID, toID)
+	if err != nil {
+		return nil, err
+	}
 
-// GetHistoryHandler обрабатывает запрос на получение истории транзакций для указанного кошелька
-func (h *HTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	walletID := vars["walletId"]
+	if sweep, ok := sweeps[toID]; ok {
+		err = applySweep(ctx, tx, sweep)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	history, err := h.store.GetHistory(walletID)
+	// Балансы обоих участников читаются после всех обновлений, включая вывод излишка
+	var balanceAfter, recipientBalanceAfter Amount
+	err = tx.QueryRowContext(ctx, "SELECT (SELECT balance FROM wallets WHERE id = $1), (SELECT balance FROM wallets WHERE id = $2)",
+		fromID, toID).Scan(&balanceAfter, &recipientBalanceAfter)
 	if err != nil {
-		responseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
-		return
+		return nil, err
 	}
 
-	responseJSON(w, http.StatusOK, history)
-}
-
-// GetWalletHandler обрабатывает запрос на получение текущего состояния кошелька
-func (h *HTTPHandler) GetWalletHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	walletID := vars["walletId"]
+	result := &TransferResult{
+		Message:               "transfer successful",
+		Amount:                amount,
+		Fee:                   fee,
+		TotalDebited:          debit,
+		BalanceBefore:         fromBalance,
+		BalanceAfter:          balanceAfter,
+		RecipientBalanceAfter: recipientBalanceAfter,
+		DuplicateWarning:      duplicate,
+		Transaction:           &records[0],
+	}
+	if len(records) > 1 {
+		result.FeeTransaction = &records[1]
+	}
 
-	wallet, err := h.store.GetWallet(walletID)
-	if err != nil {
-		responseJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
-		return
+	if opts.IdempotencyKey != "" {
+		response, err := json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE idempotency_keys SET transaction_id = $1, response = $2 WHERE scope = $3 AND key = $4",
+			records[0].ID, response, scope, opts.IdempotencyKey)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	responseJSON(w, http.StatusOK, wallet)
+	return result, nil
 }
 
-func responseJSON(w http.ResponseWriter, status int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
-}
+// TransferBatch атомарно переводит средства с одного кошелька нескольким получателям:
+// либо проводятся все переводы пакета, либо ни один. Переводы одному получателю
+// зачисляются одной суммой, но в историю записывается каждый перевод пакета.
+// Комиссия за каждый перевод пакета оплачивается отправителем.
+func (s *DBStore) TransferBatch(ctx context.Context, fromID string, items []TransferItem) error {
+	if len(items) == 0 {
+		return ErrEmptyBatch
+	}
 
-func main() {
-	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname))
-	if err != nil {
-		log.Fatal(err)
+	// counts считает строки журнала каждого получателя, sent — отправителя
+	var total Amount
+	var sent int
+	credits := make(map[string]Amount)
+	counts := make(map[string]int)
+	records := make([][]Transaction, len(items))
+	for i, item := range items {
+		err := s.validateTransfer(fromID, item.To, item.Amount, TransferOptions{})
+		if err != nil {
+			return err
+		}
+		fee, debit, credit := s.fees.apply(item.Amount, FeePayerSender)
+		records[i] = s.records(Transaction{From: fromID, To: item.To, Amount: item.Amount, Fee: fee, FeePayer: FeePayerSender})
+		total += debit
+		credits[item.To] += credit
+		counts[item.To] += len(records[i])
+		sent += len(records[i])
 	}
-	defer db.Close()
 
-	err = db.Ping()
-	if err != nil {
-		log.Fatal(err)
+	recipients := make([]string, 0, len(credits))
+	for to := range credits {
+		recipients = append(recipients, to)
 	}
+	sort.Strings(recipients)
 
-	store := NewDBStore(db)
-	handler := NewHTTPHandler(store)
+	creditedWallets := make([]string, 0, len(recipients))
+	for _, to := range recipients {
+		if credits[to] > 0 {
+			creditedWallets = append(creditedWallets, to)
+		}
+	}
+
+	return s.withTxRetry(ctx, nil, func(tx *sql.Tx) error {
+		sweeps, err := sweepsFor(ctx, tx, creditedWallets...)
+		if err != nil {
+			return err
+		}
+		err = lockWallets(ctx, tx, append(append([]string{fromID}, recipients...), sweepTargets(sweeps)...)...)
+		if err != nil {
+			return err
+		}
 
-	//маршруты
-	r := mux.NewRouter()
-	r.HandleFunc("/api/v1/wallet", handler.CreateWalletHandler).Methods("POST")
-	r.HandleFunc("/api/v1/wallet/{walletId}/send", handler.TransferHandler).Methods("POST")
-	r.HandleFunc("/api/v1/wallet/{walletId}/history", handler.GetHistoryHandler).Methods("GET")
-	r.HandleFunc("/api/v1/wallet/{walletId}", handler.GetWalletHandler).Methods("GET")
+		var fromBalance Amount
+		var currency string
+		var active bool
+		err = tx.QueryRowContext(ctx, "SELECT balance, currency, active FROM wallets WHERE id = $1", fromID).Scan(&fromBalance, &currency, &active)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrWalletNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !active {
+			return ErrWalletInactive
+		}
+		for _, item := range items {
+			if err := item.Amount.checkPrecision(currency); err != nil {
+				return err
+			}
+		}
+
+		if fromBalance+s.overdraftLimit < total {
+			return ErrInsufficientFunds
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE wallets SET balance = balance - $1, version = version + 1, transaction_count = transaction_count + $2 WHERE id = $3",
+			total, sent, fromID)
+		if err != nil {
+			return err
+		}
+
+		for _, to := range recipients {
+			if s.autoCreateRecipient {
+				_, err = tx.ExecContext(ctx, "INSERT INTO wallets (id, balance, currency) VALUES ($1, 0, $2) ON CONFLICT (id) DO NOTHING", to, currency)
+				if err != nil {
+					return err
+				}
+			}
+			err = checkRecipient(ctx, tx, to, currency)
+			if errors.Is(err, ErrRecipientNotFound) {
+				return fmt.Errorf("%w: %s", ErrRecipientNotFound, to)
+			}
+			if err != nil {
+				return err
+			}
+
+			res, err := tx.ExecContext(ctx, "UPDATE wallets SET balance = balance + $1, version = version + 1, transaction_count = transaction_count + $2 WHERE id = $3",
+				credits[to], counts[to], to)
+			if err != nil {
+				return err
+			}
+			credited, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if credited == 0 {
+				return fmt.Errorf("%w: %s", ErrRecipientNotFound, to)
+			}
+		}
+
+		for i, item := range items {
+			category, err := matchCategory(ctx, tx, fromID, item.To)
+			if err != nil {
+				return err
+			}
+			for j := range records[i] {
+				records[i][j].Category = category.String
+			}
+			err = insertTransactions(ctx, tx, records[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		// Вывод излишка выполняется после всех зачислений, чтобы учитывать итоговый баланс получателя
+		for _, to := range creditedWallets {
+			if sweep, ok := sweeps[to]; ok {
+				err = applySweep(ctx, tx, sweep)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// lockWallets блокирует строки существующих кошельков из ids в порядке их ID. Транзакции, меняющие
+// несколько кошельков, блокируют их через lockWallets до любых изменений: при едином порядке
+// встречные переводы A→B и B→A ждут друг друга, но не приводят к взаимоблокировке.
+func lockWallets(ctx context.Context, tx *sql.Tx, ids ...string) error {
+	// Блокировки захватываются по мере чтения строк, уже отсортированных по ID
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM wallets WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// checkRecipient проверяет, что получатель существует, активен и его валюта совпадает с валютой отправителя
+func checkRecipient(ctx context.Context, tx *sql.Tx, toID, currency string) error {
+	var toCurrency string
+	var active bool
+	err := tx.QueryRowContext(ctx, "SELECT currency, active FROM wallets WHERE id = $1", toID).Scan(&toCurrency, &active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecipientNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("recipient %w", ErrWalletInactive)
+	}
+	if toCurrency != currency {
+		return ErrCurrencyMismatch
+	}
+	return nil
+}
+
+// matchCategory возвращает категорию из первого подходящего правила категоризации
+func matchCategory(ctx context.Context, tx *sql.Tx, fromID, toID string) (sql.NullString, error) {
+	var category sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT category FROM category_rules
+		WHERE (from_wallet IS NULL OR from_wallet = $1) AND (to_wallet IS NULL OR to_wallet = $2)
+		ORDER BY id LIMIT 1`, fromID, toID).Scan(&category)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return category, err
+	}
+	return category, nil
+}
+
+// sweepsFor возвращает настройки автоматического вывода кошельков ids, для которых он настроен.
+// Настройки читаются до lockWallets, чтобы целевые кошельки вошли в упорядоченный набор блокировок:
+// иначе вывод блокировал бы цель позже остальных и мог бы образовать взаимоблокировку со встречным переводом.
+func sweepsFor(ctx context.Context, tx *sql.Tx, ids ...string) (map[string]SweepConfig, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT wallet_id, threshold, target_wallet FROM wallet_sweeps WHERE wallet_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sweeps := make(map[string]SweepConfig)
+	for rows.Next() {
+		var sweep SweepConfig
+		err := rows.Scan(&sweep.WalletID, &sweep.Threshold, &sweep.Target)
+		if err != nil {
+			return nil, err
+		}
+		sweeps[sweep.WalletID] = sweep
+	}
+	return sweeps, rows.Err()
+}
+
+// sweepTargets возвращает целевые кошельки настроек вывода
+func sweepTargets(sweeps map[string]SweepConfig) []string {
+	targets := make([]string, 0, len(sweeps))
+	for _, sweep := range sweeps {
+		targets = append(targets, sweep.Target)
+	}
+	return targets
+}
+
+// applySweep переводит излишек баланса сверх порога на целевой кошелек по настройке sweep.
+// Выполняется в транзакции входящего перевода, когда кошелек и цель уже заблокированы через lockWallets,
+// и записывается в историю с категорией sweep.
+func applySweep(ctx context.Context, tx *sql.Tx, sweep SweepConfig) error {
+	// На деактивированный кошелек излишек не выводится
+	var targetActive bool
+	err := tx.QueryRowContext(ctx, "SELECT active FROM wallets WHERE id = $1", sweep.Target).Scan(&targetActive)
+	if err != nil || !targetActive {
+		return err
+	}
+
+	var balance Amount
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM wallets WHERE id = $1", sweep.WalletID).Scan(&balance)
+	if err != nil {
+		return err
+	}
+
+	excess := balance - sweep.Threshold
+	if excess <= 0 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE wallets SET balance = balance - $1, version = version + 1, transaction_count = transaction_count + 1 WHERE id = $2", excess, sweep.WalletID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE wallets SET balance = balance + $1, version = version + 1, transaction_count = transaction_count + 1 WHERE id = $2", excess, sweep.Target)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO transactions (from_wallet, to_wallet, amount, category) VALUES ($1, $2, $3, 'sweep')", sweep.WalletID, sweep.Target, excess)
+	return err
+}
+
+// SetSweep сохраняет настройку автоматического вывода для кошелька
+func (s *DBStore) SetSweep(ctx context.Context, sweep SweepConfig) error {
+	// Вывод возможен только между кошельками в одной валюте
+	var currencies int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(DISTINCT currency) FROM wallets WHERE id IN ($1, $2)", sweep.WalletID, sweep.Target).Scan(&currencies)
+	if err != nil {
+		return err
+	}
+	if currencies > 1 {
+		return ErrCurrencyMismatch
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO wallet_sweeps (wallet_id, threshold, target_wallet) VALUES ($1, $2, $3)
+		ON CONFLICT (wallet_id) DO UPDATE SET threshold = EXCLUDED.threshold, target_wallet = EXCLUDED.target_wallet`,
+		sweep.WalletID, sweep.Threshold, sweep.Target)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		// foreign_key_violation: кошелек или целевой кошелек не существует
+		return ErrWalletNotFound
+	}
+	return err
+}
+
+// GetSweep возвращает настройку автоматического вывода для кошелька
+func (s *DBStore) GetSweep(ctx context.Context, walletID string) (*SweepConfig, error) {
+	sweep := SweepConfig{WalletID: walletID}
+	err := s.db.QueryRowContext(ctx, "SELECT threshold, target_wallet FROM wallet_sweeps WHERE wallet_id = $1", walletID).Scan(&sweep.Threshold, &sweep.Target)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSweepNotConfigured
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sweep, nil
+}
+
+// DeleteSweep отключает автоматический вывод для кошелька
+func (s *DBStore) DeleteSweep(ctx context.Context, walletID string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM wallet_sweeps WHERE wallet_id = $1", walletID)
+	return err
+}
+
+// insertTransactions записывает строки журнала и заполняет их ID и время, присвоенные базой данных
+func insertTransactions(ctx context.Context, tx *sql.Tx, records []Transaction) error {
+	for i := range records {
+		t := &records[i]
+		err := tx.QueryRowContext(ctx, `INSERT INTO transactions (from_wallet, to_wallet, amount, fee, fee_payer, category, receipt_ref, group_id)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, '')::uuid) RETURNING id, time`,
+			t.From, t.To, t.Amount, t.Fee, t.FeePayer, t.Category, t.ReceiptRef, t.GroupID).Scan(&t.ID, &t.Time)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimIdempotencyKey занимает ключ идемпотентности в транзакции перевода. Если ключ уже использован,
+// возвращается сохраненный результат. Конкурирующий запрос с тем же ключом блокируется на вставке
+// до завершения первого и затем получает его результат, поэтому перевод не проводится дважды.
+func (s *DBStore) claimIdempotencyKey(ctx context.Context, tx *sql.Tx, scope, key string) (*TransferResult, error) {
+	// Просроченный ключ считается свободным
+	_, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND created_at < now() - $3 * interval '1 second'",
+		scope, key, s.idempotencyTTL.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO idempotency_keys (scope, key) VALUES ($1, $2) ON CONFLICT DO NOTHING", scope, key)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if claimed == 1 {
+		return nil, nil
+	}
+
+	var response []byte
+	err = tx.QueryRowContext(ctx, "SELECT response FROM idempotency_keys WHERE scope = $1 AND key = $2", scope, key).Scan(&response)
+	if err != nil {
+		return nil, err
+	}
+
+	var result TransferResult
+	err = json.Unmarshal(response, &result)
+	if err != nil {
+		return nil, err
+	}
+	result.Replayed = true
+	return &result, nil
+}
+
+// PurgeIdempotencyKeys удаляет ключи идемпотентности старше срока хранения
+func (s *DBStore) PurgeIdempotencyKeys(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < now() - $1 * interval '1 second'", s.idempotencyTTL.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetHistory возвращает страницу истории транзакций указанного кошелька, начиная с самых новых
+func (s *DBStore) GetHistory(ctx context.Context, walletID string, filter HistoryFilter, limit, offset int) ([]Transaction, error) {
+	// Пустая история должна отличаться от несуществующего кошелька
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM wallets WHERE id = $1)", walletID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWalletNotFound
+	}
+
+	args := []any{walletID}
+	var where string
+	switch filter.Direction {
+	case "in":
+		where = "to_wallet = $1"
+	case "out":
+		where = "from_wallet = $1"
+	default:
+		where = "(from_wallet = $1 OR to_wallet = $1)"
+	}
+	// Нижняя граница включается, верхняя нет, чтобы смежные интервалы не пересекались
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		where += fmt.Sprintf(" AND time >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		where += fmt.Sprintf(" AND time < $%d", len(args))
+	}
+	args = append(args, limit, offset)
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`SELECT id, time, from_wallet, to_wallet, amount, fee, fee_payer, COALESCE(category, ''), COALESCE(receipt_ref, ''), COALESCE(group_id::text, '') FROM transactions
+		WHERE %s ORDER BY time DESC LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []Transaction
+	for rows.Next() {
+		var transaction Transaction
+		err := rows.Scan(&transaction.ID, &transaction.Time, &transaction.From, &transaction.To, &transaction.Amount, &transaction.Fee, &transaction.FeePayer,
+			&transaction.Category, &transaction.ReceiptRef, &transaction.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, transaction)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// CountHistory возвращает количество транзакций кошелька из кэширующего счетчика
+func (s *DBStore) CountHistory(ctx context.Context, walletID string) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, "SELECT transaction_count FROM wallets WHERE id = $1", walletID).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrWalletNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ReconcileTransactionCounts пересчитывает счетчики транзакций, разошедшиеся с фактической историей,
+// и возвращает количество исправленных кошельков. История агрегируется одним проходом по transactions.
+//
+// Счетчик исправляется на величину расхождения, а не перезаписывается: кэш и число транзакций
+// читаются из одного снимка, а перевод меняет их вместе. Если перевод зафиксирован после снимка,
+// UPDATE дождется его блокировки и прибавит поправку к уже увеличенному счетчику, не потеряв инкремент.
+func (s *DBStore) ReconcileTransactionCounts(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE wallets w SET transaction_count = w.transaction_count + (c.actual - c.cached)
+		FROM (SELECT w2.id, w2.transaction_count AS cached, COALESCE(t.actual, 0) AS actual
+			FROM wallets w2
+			LEFT JOIN (SELECT wallet_id, COUNT(*) AS actual
+				FROM (SELECT from_wallet AS wallet_id FROM transactions
+					UNION ALL
+					SELECT to_wallet FROM transactions) sides
+				GROUP BY wallet_id) t ON t.wallet_id = w2.id) c
+		WHERE w.id = c.id AND c.cached <> c.actual`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Recipients возвращает кошельки, в которые переводил указанный кошелек, в порядке убывания общей суммы
+func (s *DBStore) Recipients(ctx context.Context, walletID string) ([]Recipient, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM wallets WHERE id = $1)", walletID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWalletNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT to_wallet, COUNT(*), SUM(amount) FROM transactions
+		WHERE from_wallet = $1 AND to_wallet <> $1 AND NOT `+feeRecordSQL+`
+		GROUP BY to_wallet ORDER BY SUM(amount) DESC, to_wallet`, walletID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []Recipient{}
+	for rows.Next() {
+		var recipient Recipient
+		err := rows.Scan(&recipient.WalletID, &recipient.Count, &recipient.Total)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+// ReplayBalance пересчитывает баланс кошелька от начального, последовательно применяя все его транзакции
+func (s *DBStore) ReplayBalance(ctx context.Context, walletID string) (*BalanceReplay, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	replay := &BalanceReplay{WalletID: walletID, Steps: []BalanceReplayStep{}}
+	err = tx.QueryRowContext(ctx, "SELECT initial_balance, balance FROM wallets WHERE id = $1", walletID).Scan(&replay.InitialBalance, &replay.StoredBalance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Запись транзакции выполняется под блокировкой кошелька, поэтому порядок ID совпадает с порядком
+	// изменений баланса, а время транзакции — время ее начала — может с ним расходиться
+	rows, err := tx.QueryContext(ctx, `SELECT id, time, `+balanceDeltaSQL+`
+		FROM transactions WHERE from_wallet = $1 OR to_wallet = $1 ORDER BY id`, walletID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balance := replay.InitialBalance
+	for rows.Next() {
+		var step BalanceReplayStep
+		err := rows.Scan(&step.TransactionID, &step.Time, &step.Delta)
+		if err != nil {
+			return nil, err
+		}
+		balance += step.Delta
+		step.Balance = balance
+		replay.Steps = append(replay.Steps, step)
+		if replay.FirstDivergence == nil && balance < -s.overdraftLimit {
+			replay.FirstDivergence = &step
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	replay.ComputedBalance = balance
+	replay.Divergence = replay.StoredBalance - replay.ComputedBalance
+	replay.Consistent = replay.Divergence == 0 && replay.FirstDivergence == nil
+
+	return replay, nil
+}
+
+// CounterpartyCounts возвращает количество транзакций кошелька с каждым контрагентом,
+// учитывая как исходящие, так и входящие переводы
+func (s *DBStore) CounterpartyCounts(ctx context.Context, walletID string) ([]CounterpartyCount, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM wallets WHERE id = $1)", walletID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWalletNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT CASE WHEN from_wallet = $1 THEN to_wallet ELSE from_wallet END AS counterparty,
+			COUNT(*) FILTER (WHERE from_wallet = $1), COUNT(*) FILTER (WHERE to_wallet = $1), COUNT(*)
+		FROM transactions
+		WHERE (from_wallet = $1 OR to_wallet = $1) AND from_wallet <> to_wallet AND NOT `+feeRecordSQL+`
+		GROUP BY counterparty ORDER BY COUNT(*) DESC, counterparty`, walletID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []CounterpartyCount{}
+	for rows.Next() {
+		var count CounterpartyCount
+		err := rows.Scan(&count.WalletID, &count.Sent, &count.Received, &count.Total)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// MonthlyOpeningBalances возвращает баланс кошелька на начало каждого месяца указанного года (UTC),
+// восстановленный вычитанием из текущего баланса всех последующих движений
+func (s *DBStore) MonthlyOpeningBalances(ctx context.Context, walletID string, year int) ([]MonthlyBalance, error) {
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var balance Amount
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM wallets WHERE id = $1", walletID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT date_trunc('month', time AT TIME ZONE 'UTC') AS month,
+		SUM(`+balanceDeltaSQL+`)
+		FROM transactions WHERE (from_wallet = $1 OR to_wallet = $1) AND time >= $2
+		GROUP BY month`, walletID, start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Движения после конца года относятся к последнему месяцу, чтобы учесть их при вычитании
+	var deltas [12]Amount
+	for rows.Next() {
+		var month time.Time
+		var delta Amount
+		err := rows.Scan(&month, &delta)
+		if err != nil {
+			return nil, err
+		}
+		i := 11
+		if month.Year() == year {
+			i = int(month.Month()) - 1
+		}
+		deltas[i] += delta
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	balances := make([]MonthlyBalance, 12)
+	opening := balance
+	for i := 11; i >= 0; i-- {
+		opening -= deltas[i]
+		balances[i] = MonthlyBalance{
+			Month:   start.AddDate(0, i, 0).Format("2006-01"),
+			Opening: opening,
+		}
+	}
+
+	return balances, nil
+}
+
+// Velocity возвращает количество и сумму входящих и исходящих транзакций кошелька за последнее окно времени
+func (s *DBStore) Velocity(ctx context.Context, walletID string, window time.Duration) (*Velocity, error) {
+	velocity := Velocity{Window: window.String()}
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM transactions
+		WHERE (from_wallet = $1 OR to_wallet = $1) AND time >= now() - $2 * interval '1 second' AND NOT `+feeRecordSQL,
+		walletID, window.Seconds()).Scan(&velocity.Count, &velocity.Total)
+	if err != nil {
+		return nil, err
+	}
+	return &velocity, nil
+}
+
+// BalanceSeries возвращает баланс кошелька на конец каждого интервала, восстановленный по истории транзакций
+func (s *DBStore) BalanceSeries(ctx context.Context, walletID string, interval string) ([]BalancePoint, error) {
+	if !seriesIntervals[interval] {
+		return nil, ErrInvalidInterval
+	}
+
+	// Баланс и история читаются из одного снимка, чтобы ряд сходился с текущим балансом
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var balance Amount
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM wallets WHERE id = $1", walletID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT date_trunc($2, time) AS bucket,
+		SUM(`+balanceDeltaSQL+`)
+		FROM transactions WHERE from_wallet = $1 OR to_wallet = $1
+		GROUP BY bucket ORDER BY bucket`, walletID, interval)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []BalancePoint
+	var total Amount
+	for rows.Next() {
+		var point BalancePoint
+		var delta Amount
+		err := rows.Scan(&point.Time, &delta)
+		if err != nil {
+			return nil, err
+		}
+		total += delta
+		point.Balance = total
+		series = append(series, point)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Начальный баланс получается вычитанием всех движений из текущего баланса
+	opening := balance - total
+	for i := range series {
+		series[i].Balance += opening
+	}
+
+	return series, nil
+}
+
+// HasTransacted проверяет, были ли между двумя кошельками переводы в любом направлении.
+// Если хотя бы одного из кошельков нет, возвращается ErrWalletNotFound.
+func (s *DBStore) HasTransacted(ctx context.Context, walletID, otherID string) (bool, error) {
+	var found int
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM wallets WHERE id IN ($1, $2)),
+		EXISTS (SELECT 1 FROM transactions WHERE (from_wallet = $1 AND to_wallet = $2) OR (from_wallet = $2 AND to_wallet = $1))`,
+		walletID, otherID).Scan(&found, &exists)
+	if err != nil {
+		return false, err
+	}
+	want := 2
+	if walletID == otherID {
+		want = 1
+	}
+	if found < want {
+		return false, ErrWalletNotFound
+	}
+	return exists, nil
+}
+
+// LastActivity возвращает последнюю транзакцию каждого из указанных кошельков.
+// Кошельки без транзакций в результат не попадают.
+func (s *DBStore) LastActivity(ctx context.Context, walletIDs []string) (map[string]Transaction, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT ON (w.id) w.id, t.id, t.time, t.from_wallet, t.to_wallet, t.amount, t.fee, t.fee_payer, COALESCE(t.category, ''), COALESCE(t.receipt_ref, ''), COALESCE(t.group_id::text, '')
+		FROM unnest($1::text[]) AS w(id)
+		JOIN transactions t ON t.from_wallet = w.id OR t.to_wallet = w.id
+		ORDER BY w.id, t.time DESC`, pq.Array(walletIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activity := make(map[string]Transaction)
+	for rows.Next() {
+		var walletID string
+		var transaction Transaction
+		err := rows.Scan(&walletID, &transaction.ID, &transaction.Time, &transaction.From, &transaction.To, &transaction.Amount, &transaction.Fee, &transaction.FeePayer,
+			&transaction.Category, &transaction.ReceiptRef, &transaction.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		activity[walletID] = transaction
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return activity, nil
+}
+
+// CreateCategoryRule сохраняет новое правило категоризации транзакций
+func (s *DBStore) CreateCategoryRule(ctx context.Context, rule CategoryRule) (*CategoryRule, error) {
+	err := s.db.QueryRowContext(ctx, "INSERT INTO category_rules (from_wallet, to_wallet, category) VALUES (NULLIF($1, ''), NULLIF($2, ''), $3) RETURNING id",
+		rule.From, rule.To, rule.Category).Scan(&rule.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// ListCategoryRules возвращает все правила категоризации в порядке их применения
+func (s *DBStore) ListCategoryRules(ctx context.Context) ([]CategoryRule, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, COALESCE(from_wallet, ''), COALESCE(to_wallet, ''), category FROM category_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []CategoryRule{}
+	for rows.Next() {
+		var rule CategoryRule
+		err := rows.Scan(&rule.ID, &rule.From, &rule.To, &rule.Category)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// BalanceDistribution разбивает диапазон балансов на равные интервалы и считает кошельки в каждом.
+// Кошельки с максимальным балансом относятся к последнему интервалу.
+func (s *DBStore) BalanceDistribution(ctx context.Context, buckets int) ([]BalanceBucket, error) {
+	// Границы интервалов считаются в основных единицах, балансы хранятся в минимальных
+	rows, err := s.db.QueryContext(ctx, `WITH bounds AS (SELECT MIN(balance) / $2::numeric AS lo, MAX(balance) / $2::numeric AS hi FROM wallets)
+		SELECT CASE WHEN hi = lo THEN 1 ELSE LEAST(width_bucket(balance / $2::numeric, lo, hi, $1), $1) END AS bucket, COUNT(*), lo, hi
+		FROM wallets, bounds
+		GROUP BY bucket, lo, hi`, buckets, amountUnit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int64)
+	var lo, hi float64
+	for rows.Next() {
+		var bucket int
+		var count int64
+		err := rows.Scan(&bucket, &count, &lo, &hi)
+		if err != nil {
+			return nil, err
+		}
+		counts[bucket] = count
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	distribution := []BalanceBucket{}
+	if len(counts) == 0 {
+		return distribution, nil
+	}
+
+	width := (hi - lo) / float64(buckets)
+	for i := 1; i <= buckets; i++ {
+		distribution = append(distribution, BalanceBucket{
+			From:  lo + float64(i-1)*width,
+			To:    lo + float64(i)*width,
+			Count: counts[i],
+		})
+	}
+
+	return distribution, nil
+}
+
+// CurrencyTotals возвращает количество кошельков и сумму балансов по каждой валюте в порядке кода валюты
+func (s *DBStore) CurrencyTotals(ctx context.Context) ([]CurrencyTotal, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT currency, COUNT(*), COALESCE(SUM(balance), 0) FROM wallets GROUP BY currency ORDER BY currency")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []CurrencyTotal{}
+	for rows.Next() {
+		var total CurrencyTotal
+		err := rows.Scan(&total.Currency, &total.WalletCount, &total.TotalBalance)
+		if err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return totals, nil
+}
+
+// Stats возвращает сводные показатели одним агрегирующим запросом в транзакции только для чтения
+func (s *DBStore) Stats(ctx context.Context) (*Stats, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var stats Stats
+	err = tx.QueryRowContext(ctx, `SELECT w.count, w.balance, w.initial_balance, t.count, t.volume, t.fees
+		FROM (SELECT COUNT(*) AS count, COALESCE(SUM(balance), 0) AS balance, COALESCE(SUM(initial_balance), 0) AS initial_balance FROM wallets) w,
+			(SELECT COUNT(*) AS count, COALESCE(SUM(amount), 0) AS volume, COALESCE(SUM(fee), 0) AS fees FROM transactions) t`).
+		Scan(&stats.WalletCount, &stats.TotalBalance, &stats.TotalInitialBalance, &stats.TransactionCount, &stats.TransferVolume, &stats.FeesCollected)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// DormantWallets возвращает кошельки без транзакций начиная с указанного момента
+func (s *DBStore) DormantWallets(ctx context.Context, since time.Time) ([]Wallet, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, balance, currency, version, active FROM wallets w
+		WHERE NOT EXISTS (SELECT 1 FROM transactions t WHERE (t.from_wallet = w.id OR t.to_wallet = w.id) AND t.time >= $1)
+		ORDER BY id`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	wallets := []Wallet{}
+	for rows.Next() {
+		var wallet Wallet
+		err := rows.Scan(&wallet.ID, &wallet.Balance, &wallet.Currency, &wallet.Version, &wallet.Active)
+		if err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, wallet)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return wallets, nil
+}
+
+// LargeTransactions возвращает транзакции с суммой выше порога, начиная с самых новых
+func (s *DBStore) LargeTransactions(ctx context.Context, threshold Amount, limit, offset int) ([]Transaction, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, time, from_wallet, to_wallet, amount, fee, fee_payer, COALESCE(category, ''), COALESCE(receipt_ref, ''), COALESCE(group_id::text, '') FROM transactions
+		WHERE amount > $1 ORDER BY time DESC LIMIT $2 OFFSET $3`, threshold, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		var transaction Transaction
+		err := rows.Scan(&transaction.ID, &transaction.Time, &transaction.From, &transaction.To, &transaction.Amount, &transaction.Fee, &transaction.FeePayer,
+			&transaction.Category, &transaction.ReceiptRef, &transaction.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// RecordAudit сохраняет запись в журнал аудита
+func (s *DBStore) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO audit_log (caller, method, path, wallet_id, status) VALUES ($1, $2, $3, NULLIF($4, ''), $5)",
+		entry.Caller, entry.Method, entry.Path, entry.WalletID, entry.Status)
+	return err
+}
+
+// ListAudit возвращает последние записи журнала аудита, при необходимости только по указанному кошельку
+func (s *DBStore) ListAudit(ctx context.Context, walletID string, limit int) ([]AuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, time, caller, method, path, COALESCE(wallet_id, ''), status FROM audit_log
+		WHERE $1 = '' OR wallet_id = $1
+		ORDER BY id DESC LIMIT $2`, walletID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(&entry.ID, &entry.Time, &entry.Caller, &entry.Method, &entry.Path, &entry.WalletID, &entry.Status)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// handlerConfig содержит настройки обработчика HTTP-запросов
+type handlerConfig struct {
+	// problemJSON включает формат ошибок application/problem+json для всех клиентов
+	problemJSON bool
+	// maxBatchSize ограничивает количество элементов в запросах ко всем пакетным эндпоинтам
+	maxBatchSize int
+	// largeTransactionThreshold задает сумму, выше которой транзакция считается крупной
+	largeTransactionThreshold Amount
+	// maxHistoryRows задает максимальный размер страницы истории
+	maxHistoryRows int
+	// maxExportRows ограничивает число транзакций в одной выгрузке OFX или QIF
+	maxExportRows int
+	// strictJSON включает строгий разбор тел запросов, см. decodeJSON
+	strictJSON bool
+	// maxRequestBytes ограничивает размер тела запроса в строгом режиме
+	maxRequestBytes int64
+	// balanceCacheControl и historyCacheControl задают Cache-Control для чтения баланса и истории
+	balanceCacheControl string
+	historyCacheControl string
+	// streamKeepAlive задает интервал комментариев, поддерживающих простаивающий поток событий
+	streamKeepAlive time.Duration
+	// requestTimeout ограничивает время обработки запроса, включая запросы к хранилищу, 0 отключает ограничение
+	requestTimeout time.Duration
+	// exportTimeout заменяет requestTimeout для выгрузок истории в OFX и QIF, 0 отключает ограничение
+	exportTimeout time.Duration
+	// walletSort задает порядок списка кошельков, если он не указан в запросе
+	walletSort WalletSort
+	// moneyObjects записывает баланс и суммы транзакций в ответах кошелька и истории объектами Money
+	// вместо чисел
+	moneyObjects bool
+}
+
+// defaultHandlerConfig возвращает настройки обработчика по умолчанию
+func defaultHandlerConfig() handlerConfig {
+	return handlerConfig{
+		maxBatchSize:              100,
+		largeTransactionThreshold: 10000_00,
+		maxHistoryRows:            200,
+		maxExportRows:             100000,
+		strictJSON:                true,
+		maxRequestBytes:           16 << 10,
+		balanceCacheControl:       "private, max-age=5",
+		historyCacheControl:       "no-store",
+		streamKeepAlive:           15 * time.Second,
+		requestTimeout:            10 * time.Second,
+		exportTimeout:             time.Minute,
+		walletSort:                WalletSort{Field: "id"},
+	}
+}
+
+type HTTPHandler struct {
+	handlerConfig
+
+	store Store
+	// db задан, если хранилище работает на PostgreSQL; аналитика, администрирование, пакетные
+	// переводы и аудит доступны только с ним
+	db *DBStore
+	// currencies содержит коды валют, в которых можно создавать кошельки
+	currencies map[string]bool
+	// transferLimiter ограничивает частоту переводов с одного кошелька, nil отключает ограничение
+	transferLimiter *walletRateLimiter
+	// apiKeys содержит SHA-256 допустимых API-ключей с их уровнями доступа, nil отключает аутентификацию
+	apiKeys []apiKey
+	// feed раздает новые транзакции потокам событий кошельков, доступен только с PostgreSQL
+	feed    *transactionFeed
+	metrics *metrics
+}
+
+func NewHTTPHandler(store Store) *HTTPHandler {
+	h := &HTTPHandler{
+		handlerConfig: defaultHandlerConfig(),
+		store:         store,
+		currencies:    make(map[string]bool),
+		metrics:       newMetrics(),
+	}
+	if db, ok := store.(*DBStore); ok {
+		h.db = db
+	}
+	return h
+}
+
+// CreateWalletHandler обрабатывает запрос на создание нового кошелька
+func (h *HTTPHandler) CreateWalletHandler(w http.ResponseWriter, r *http.Request) {
+	// Тело запроса необязательно: без него кошелек создается в базовой валюте
+	var request struct {
+		Currency string `json:"currency"`
+	}
+	if r.ContentLength != 0 && !h.decodeJSON(w, r, &request) {
+		return
+	}
+	if request.Currency != "" && !h.currencies[request.Currency] {
+		h.responseError(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported currency %q", request.Currency))
+		return
+	}
+
+	wallet, err := h.store.CreateWallet(r.Context(), request.Currency)
+	if errors.Is(err, ErrWalletExists) {
+		h.responseError(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to create wallet")
+		return
+	}
+	responseJSON(w, http.StatusOK, wallet)
+}
+
+// TransferHandler обрабатывает запрос на перевод средств между кошельками
+func (h *HTTPHandler) TransferHandler(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+
+	vars := mux.Vars(r)
+	fromID := vars["walletId"]
+
+	var request struct {
+		To         string `json:"to"`
+		Amount     Amount `json:"amount"`
+		ReceiptRef string `json:"receipt_ref"`
+		FeePayer   string `json:"fee_payer"`
+	}
+
+	if !h.decodeJSON(w, r, &request, "to", "amount") {
+		return
+	}
+	if !validWalletID(request.To) {
+		h.responseError(w, r, http.StatusBadRequest, "invalid wallet id")
+		return
+	}
+
+	opts := TransferOptions{
+		ReceiptRef:     request.ReceiptRef,
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		Caller:         callerKey(r),
+		FeePayer:       request.FeePayer,
+	}
+	if len(opts.IdempotencyKey) > 255 {
+		h.responseError(w, r, http.StatusBadRequest, "invalid Idempotency-Key: at most 255 characters allowed")
+		return
+	}
+	if v := r.URL.Query().Get("create_recipient"); v != "" {
+		createRecipient, err := strconv.ParseBool(v)
+		if err != nil {
+			h.responseError(w, r, http.StatusBadRequest, "invalid create_recipient")
+			return
+		}
+		opts.CreateRecipient = createRecipient
+	}
+
+	// Точность суммы проверяется по валюте отправителя до перевода, чтобы клиент получил
+	// сообщение с названием валюты и допустимым числом знаков
+	from, err := h.store.GetWallet(r.Context(), fromID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+	if err := request.Amount.checkPrecision(from.Currency); err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := h.store.Transfer(r.Context(), fromID, request.To, request.Amount, opts)
+	// Повторно возвращенный по ключу идемпотентности результат не учитывается, так как средства не двигались
+	if err != nil || !result.Replayed {
+		h.metrics.observeTransfer(err, request.Amount.Float64())
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrWalletNotFound):
+		h.responseError(w, r, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, ErrDuplicateTransfer):
+		h.responseError(w, r, http.StatusConflict, err.Error())
+		return
+	case errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrSelfTransfer), errors.Is(err, ErrInvalidReceiptRef),
+		errors.Is(err, ErrAmountTooLarge), errors.Is(err, ErrRecipientNotFound), errors.Is(err, ErrInsufficientFunds),
+		errors.Is(err, ErrCurrencyMismatch), errors.Is(err, ErrWalletInactive), errors.Is(err, ErrInvalidFeePayer),
+		errors.Is(err, ErrFeeExceedsAmount), errors.Is(err, ErrAmountPrecision):
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	case isContextError(r, err):
+		h.responseTransferTimeout(w, r, opts.IdempotencyKey != "")
+		return
+	case isTransientError(err):
+		h.responseRetryable(w, r, "temporary failure, retry later", 200*time.Millisecond)
+		return
+	default:
+		log.Printf("transfer from %s failed: %v", fromID, err)
+		h.responseError(w, r, http.StatusInternalServerError, "failed to transfer")
+		return
+	}
+
+	if result.Replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	result.ProcessingTimeMs = float64(time.Since(started).Microseconds()) / 1000
+	responseJSON(w, http.StatusOK, result)
+}
+
+// TransferBatchHandler обрабатывает запрос на атомарный пакетный перевод средств нескольким получателям
+func (h *HTTPHandler) TransferBatchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fromID := vars["walletId"]
+
+	var request struct {
+		Transfers []TransferItem `json:"transfers"`
+	}
+	if !h.decodeJSON(w, r, &request, "transfers") {
+		return
+	}
+	if len(request.Transfers) == 0 {
+		h.responseError(w, r, http.StatusBadRequest, ErrEmptyBatch.Error())
+		return
+	}
+	if !h.checkBatchSize(w, r, len(request.Transfers)) {
+		return
+	}
+	for _, item := range request.Transfers {
+		if !validWalletID(item.To) {
+			h.responseError(w, r, http.StatusBadRequest, "invalid wallet id")
+			return
+		}
+	}
+
+	err := h.db.TransferBatch(r.Context(), fromID, request.Transfers)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrWalletNotFound):
+		h.responseError(w, r, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, ErrInvalidAmount), errors.Is(err, ErrSelfTransfer), errors.Is(err, ErrAmountTooLarge),
+		errors.Is(err, ErrRecipientNotFound), errors.Is(err, ErrInsufficientFunds), errors.Is(err, ErrEmptyBatch),
+		errors.Is(err, ErrCurrencyMismatch), errors.Is(err, ErrWalletInactive), errors.Is(err, ErrAmountPrecision):
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	case isContextError(r, err):
+		// У пакетного перевода нет ключа идемпотентности, поэтому повтор небезопасен
+		h.responseTransferTimeout(w, r, false)
+		return
+	case isTransientError(err):
+		h.responseRetryable(w, r, "temporary failure, retry later", 200*time.Millisecond)
+		return
+	default:
+		log.Printf("batch transfer from %s failed: %v", fromID, err)
+		h.responseError(w, r, http.StatusInternalServerError, "failed to transfer")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, map[string]string{"message": "batch transfer successful"})
+}
+
+// SetSweepHandler обрабатывает запрос на настройку автоматического вывода излишка баланса
+func (h *HTTPHandler) SetSweepHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	var sweep SweepConfig
+	if !h.decodeJSON(w, r, &sweep, "target", "threshold") {
+		return
+	}
+	if sweep.Target == "" || sweep.Target == walletID || sweep.Threshold < 0 {
+		h.responseError(w, r, http.StatusBadRequest, "invalid request")
+		return
+	}
+	sweep.WalletID = walletID
+
+	err := h.db.SetSweep(r.Context(), sweep)
+	if errors.Is(err, ErrCurrencyMismatch) {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, sweep)
+}
+
+// GetSweepHandler обрабатывает запрос на получение настройки автоматического вывода
+func (h *HTTPHandler) GetSweepHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	sweep, err := h.db.GetSweep(r.Context(), walletID)
+	if errors.Is(err, ErrSweepNotConfigured) {
+		h.responseError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, sweep)
+}
+
+// DeleteSweepHandler обрабатывает запрос на отключение автоматического вывода
+func (h *HTTPHandler) DeleteSweepHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	err := h.db.DeleteSweep(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWalletsHandler обрабатывает запрос на получение списка кошельков
+func (h *HTTPHandler) ListWalletsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r, min(50, h.maxHistoryRows), h.maxHistoryRows)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sort, err := parseWalletSort(r, h.walletSort)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := h.db.ListWallets(r.Context(), sort, limit, offset)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to list wallets")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, page)
+}
+
+// DeactivateWalletHandler обрабатывает запрос на деактивацию кошелька
+func (h *HTTPHandler) DeactivateWalletHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	force := false
+	if v := r.URL.Query().Get("force"); v != "" {
+		var err error
+		force, err = strconv.ParseBool(v)
+		if err != nil {
+			h.responseError(w, r, http.StatusBadRequest, "invalid force")
+			return
+		}
+	}
+
+	err := h.db.DeactivateWallet(r.Context(), walletID, force)
+	if errors.Is(err, ErrNonZeroBalance) {
+		h.responseError(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetHistoryHandler обрабатывает запрос на получение истории транзакций для указанного кошелька
+func (h *HTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			h.responseError(w, r, http.StatusBadRequest, "invalid tz")
+			return
+		}
+	}
+
+	scale, err := parseScale(r)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "ofx" && format != "qif" {
+		h.responseError(w, r, http.StatusBadRequest, "invalid format: must be json, ofx or qif")
+		return
+	}
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Выгрузка — это файл для бухгалтерской программы, а не страница, поэтому limit и offset к ней не применяются
+	if format == "ofx" || format == "qif" {
+		h.exportHistory(w, r, walletID, format, filter)
+		return
+	}
+
+	limit, offset, err := parsePagination(r, min(50, h.maxHistoryRows), h.maxHistoryRows)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Лишняя строка показывает, что за страницей есть еще транзакции
+	history, err := h.store.GetHistory(r.Context(), walletID, filter, limit+1, offset)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if len(history) > limit {
+		history = history[:limit]
+		w.Header().Set("Content-Range", fmt.Sprintf("transactions %d-%d/*", offset, offset+len(history)-1))
+		status = http.StatusPartialContent
+	}
+
+	// Валюта нужна только для денежных объектов, иначе кошелек не читается
+	var currency string
+	if h.moneyObjects {
+		wallet, err := h.store.GetWallet(r.Context(), walletID)
+		if err != nil {
+			h.responseStoreError(w, r, err)
+			return
+		}
+		currency = wallet.Currency
+	}
+
+	scaled := make([]scaledTransaction, len(history))
+	for i, transaction := range history {
+		transaction.Time = transaction.Time.In(loc)
+		scaled[i] = scaledTransaction{
+			Transaction: transaction,
+			Amount:      h.displayMoney(transaction.Amount.display(scale, -1), currency),
+			Fee:         h.displayMoney(transaction.Fee.display(scale, -1), currency),
+			Scale:       scale,
+		}
+	}
+	w.Header().Set("X-Amount-Scale", strconv.FormatInt(scale, 10))
+
+	responseJSON(w, status, scaled)
+}
+
+// exportHistory отправляет всю отфильтрованную историю кошелька одним файлом OFX или QIF.
+// Выгрузки для бухгалтерских программ всегда идут в UTC и без масштабирования.
+func (h *HTTPHandler) exportHistory(w http.ResponseWriter, r *http.Request, walletID, format string, filter HistoryFilter) {
+	wallet, err := h.store.GetWallet(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	// Лишняя строка показывает, что выгрузка не уместилась в maxExportRows. Обрезанный файл
+	// бухгалтерская программа приняла бы за полную выписку, поэтому он не отправляется.
+	history, err := h.store.GetHistory(r.Context(), walletID, filter, h.maxExportRows+1, 0)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+	if len(history) > h.maxExportRows {
+		h.responseError(w, r, http.StatusUnprocessableEntity,
+			fmt.Sprintf("export too large: more than %d transactions, narrow the period with from and to", h.maxExportRows))
+		return
+	}
+
+	write := writeQIF
+	w.Header().Set("Content-Type", "application/qif")
+	if format == "ofx" {
+		write = writeOFX
+		w.Header().Set("Content-Type", "application/x-ofx")
+	}
+	w.WriteHeader(http.StatusOK)
+	err = write(w, wallet, history)
+	if err != nil {
+		log.Printf("failed to write %s export: %v", format, err)
+	}
+}
+
+// GetWalletHandler обрабатывает запрос на получение текущего состояния кошелька
+func (h *HTTPHandler) GetWalletHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	scale, err := parseScale(r)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	precision, err := parsePrecision(r)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wallet, err := h.store.GetWallet(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	// Точнее минорных единиц валюты баланс не хранится: для JPY это целые, для USD — два знака
+	precision = min(precision, minorDigits(wallet.Currency))
+
+	w.Header().Set("X-Amount-Scale", strconv.FormatInt(scale, 10))
+
+	responseJSON(w, http.StatusOK, scaledWallet{
+		Wallet:  wallet,
+		Balance: h.displayMoney(wallet.Balance.display(scale, precision), wallet.Currency),
+		Scale:   scale,
+	})
+}
+
+// CountHistoryHandler обрабатывает запрос на получение количества транзакций кошелька
+func (h *HTTPHandler) CountHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	count, err := h.db.CountHistory(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, map[string]int64{"count": count})
+}
+
+// RecipientsHandler обрабатывает запрос на получение получателей переводов кошелька
+func (h *HTTPHandler) RecipientsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	recipients, err := h.db.Recipients(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, recipients)
+}
+
+// CounterpartyCountsHandler обрабатывает запрос на получение количества транзакций по контрагентам
+func (h *HTTPHandler) CounterpartyCountsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	counts, err := h.db.CounterpartyCounts(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, counts)
+}
+
+// MonthlyOpeningHandler обрабатывает запрос на получение балансов кошелька на начало каждого месяца года
+func (h *HTTPHandler) MonthlyOpeningHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	year, err := strconv.Atoi(r.URL.Query().Get("year"))
+	if err != nil || year < 1970 || year > 9999 {
+		h.responseError(w, r, http.StatusBadRequest, "invalid year")
+		return
+	}
+
+	balances, err := h.db.MonthlyOpeningBalances(r.Context(), walletID, year)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, balances)
+}
+
+// VelocityHandler обрабатывает запрос на получение частоты транзакций кошелька
+func (h *HTTPHandler) VelocityHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		window, err = time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			h.responseError(w, r, http.StatusBadRequest, "invalid window")
+			return
+		}
+	}
+
+	velocity, err := h.db.Velocity(r.Context(), walletID, window)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to get velocity")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, velocity)
+}
+
+// GetBalanceSeriesHandler обрабатывает запрос на получение временного ряда баланса кошелька
+func (h *HTTPHandler) GetBalanceSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+
+	series, err := h.db.BalanceSeries(r.Context(), walletID, interval)
+	if errors.Is(err, ErrInvalidInterval) {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, series)
+}
+
+// HasTransactedHandler обрабатывает запрос на проверку наличия переводов между двумя кошельками
+func (h *HTTPHandler) HasTransactedHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	otherID := r.URL.Query().Get("with")
+	if otherID == "" {
+		h.responseError(w, r, http.StatusBadRequest, "missing with parameter")
+		return
+	}
+	if !validWalletID(otherID) {
+		h.responseError(w, r, http.StatusBadRequest, "invalid with parameter: must be a wallet id")
+		return
+	}
+
+	exists, err := h.db.HasTransacted(r.Context(), walletID, otherID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, map[string]bool{"has_transacted": exists})
+}
+
+// LastActivityHandler обрабатывает запрос на получение последней транзакции для набора кошельков
+func (h *HTTPHandler) LastActivityHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		WalletIDs []string `json:"wallet_ids"`
+	}
+
+	if !h.decodeJSON(w, r, &request, "wallet_ids") {
+		return
+	}
+	if len(request.WalletIDs) == 0 {
+		h.responseError(w, r, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if !h.checkBatchSize(w, r, len(request.WalletIDs)) {
+		return
+	}
+
+	activity, err := h.db.LastActivity(r.Context(), request.WalletIDs)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to get last activity")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, activity)
+}
+
+// CreateCategoryRuleHandler обрабатывает запрос администратора на создание правила категоризации
+func (h *HTTPHandler) CreateCategoryRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule CategoryRule
+	if !h.decodeJSON(w, r, &rule, "category") {
+		return
+	}
+	if rule.Category == "" || (rule.From == "" && rule.To == "") {
+		h.responseError(w, r, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	created, err := h.db.CreateCategoryRule(r.Context(), rule)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to create category rule")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, created)
+}
+
+// ListCategoryRulesHandler обрабатывает запрос администратора на получение правил категоризации
+func (h *HTTPHandler) ListCategoryRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.db.ListCategoryRules(r.Context())
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to list category rules")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, rules)
+}
+
+// BalanceDistributionHandler обрабатывает запрос администратора на получение распределения балансов
+func (h *HTTPHandler) BalanceDistributionHandler(w http.ResponseWriter, r *http.Request) {
+	buckets := 10
+	if v := r.URL.Query().Get("buckets"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			h.responseError(w, r, http.StatusBadRequest, "invalid buckets")
+			return
+		}
+		buckets = n
+	}
+
+	distribution, err := h.db.BalanceDistribution(r.Context(), buckets)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to get balance distribution")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, distribution)
+}
+
+// CurrencyTotalsHandler обрабатывает запрос администратора на получение итогов по валютам
+func (h *HTTPHandler) CurrencyTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	totals, err := h.db.CurrencyTotals(r.Context())
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to get currency totals")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, totals)
+}
+
+// StatsHandler обрабатывает запрос на получение сводных показателей для сверки балансов
+func (h *HTTPHandler) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.db.Stats(r.Context())
+	if err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		h.responseError(w, r, http.StatusInternalServerError, "failed to get stats")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, stats)
+}
+
+// ReplayBalanceHandler обрабатывает запрос администратора на пересчет баланса кошелька по истории
+func (h *HTTPHandler) ReplayBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	replay, err := h.db.ReplayBalance(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	responseJSON(w, http.StatusOK, replay)
+}
+
+// DormantWalletsHandler обрабатывает запрос администратора на получение неактивных кошельков
+func (h *HTTPHandler) DormantWalletsHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, "invalid since")
+		return
+	}
+
+	wallets, err := h.db.DormantWallets(r.Context(), since)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to list dormant wallets")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, wallets)
+}
+
+// LargeTransactionsHandler обрабатывает запрос администратора на получение крупных транзакций
+func (h *HTTPHandler) LargeTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r, 50, 200)
+	if err != nil {
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	transactions, err := h.db.LargeTransactions(r.Context(), h.largeTransactionThreshold, limit, offset)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to list large transactions")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, transactions)
+}
+
+// ListAuditHandler обрабатывает запрос администратора на получение журнала аудита
+func (h *HTTPHandler) ListAuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			h.responseError(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	entries, err := h.db.ListAudit(r.Context(), r.URL.Query().Get("wallet_id"), limit)
+	if err != nil {
+		h.responseError(w, r, http.StatusInternalServerError, "failed to list audit log")
+		return
+	}
+
+	responseJSON(w, http.StatusOK, entries)
+}
+
+// validWalletID проверяет, что ID кошелька является UUID, как генерируемые при создании кошелька
+func validWalletID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// walletIDMiddleware отклоняет запросы с некорректным {walletId} до обращения к хранилищу
+func (h *HTTPHandler) walletIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if walletID, ok := mux.Vars(r)["walletId"]; ok && !validWalletID(walletID) {
+			h.responseError(w, r, http.StatusBadRequest, "invalid wallet id")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamRoute задает маршрут потока событий кошелька, который живет дольше любого запроса
+const streamRoute = "/api/v1/wallet/{walletId}/stream"
+
+// timeoutMiddleware отменяет контекст запроса через timeout, чтобы зависший запрос к базе
+// данных не удерживал обработчик бесконечно; срок задается при регистрации маршрута, 0 снимает ограничение
+func (h *HTTPHandler) timeoutMiddleware(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestTimedOut сообщает, что запрос прерван по истечении срока обработки маршрута
+func requestTimedOut(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+// statusRecorder запоминает код ответа и размер тела, отправленные обработчиком
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap позволяет http.ResponseController добраться до исходного ResponseWriter
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestIDPattern ограничивает принимаемые от клиента X-Request-Id безопасными символами
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// loggingMiddleware пишет одну структурированную строку на каждый запрос: метод, путь, статус,
+// размер ответа, длительность и ID запроса. ID берется из X-Request-Id клиента или генерируется
+// и возвращается в заголовке ответа.
+func loggingMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+
+		requestID := r.Header.Get("X-Request-Id")
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		logger.Info("request",
+			"request_id", requestID,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(started).Microseconds())/1000,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// callerIdentity возвращает идентификатор вызывающей стороны для журнала аудита: первые 8 байт SHA-256
+// предъявленного API-ключа и адрес клиента, например key:1a2b3c4d5e6f7a8b@10.0.0.1:5123. Сам ключ
+// в журнал не попадает; запрос без ключа записывается как anonymous@<адрес>.
+func callerIdentity(r *http.Request) string {
+	return callerKey(r) + "@" + r.RemoteAddr
+}
+
+// callerKey возвращает часть callerIdentity, определяемую API-ключом: key:<хеш> или anonymous
+func callerKey(r *http.Request) string {
+	key, ok := bearerToken(r)
+	if !ok || key == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:8])
+}
+
+// auditMiddleware записывает в журнал аудита каждый изменяющий запрос вместе с его результатом,
+// в том числе завершившийся ошибкой. Проверка доступа выполняется внутри, поэтому запросы,
+// отклоненные с 401 и 403, тоже попадают в журнал.
+func (h *HTTPHandler) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Журнал аудита хранится в PostgreSQL
+		if h.db == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			status := rec.status
+			p := recover()
+			if p != nil {
+				status = http.StatusInternalServerError
+			}
+			// Запись аудита не должна прерываться, если клиент уже отключился
+			err := h.db.RecordAudit(context.WithoutCancel(r.Context()), AuditEntry{
+				Caller:   callerIdentity(r),
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				WalletID: mux.Vars(r)["walletId"],
+				Status:   status,
+			})
+			if err != nil {
+				log.Printf("failed to record audit entry: %v", err)
+			}
+			if p != nil {
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// scaledWallet и scaledTransaction заменяют суммы их отображаемыми значениями с учетом scale и precision
+// и указывают примененный scale, чтобы масштаб был виден и без заголовка X-Amount-Scale.
+// Сумма записывается числом или объектом Money, см. displayMoney.
+type scaledWallet struct {
+	*Wallet
+	Balance any   `json:"balance"`
+	Scale   int64 `json:"scale"`
+}
+
+type scaledTransaction struct {
+	Transaction
+	Amount any   `json:"amount"`
+	Fee    any   `json:"fee"`
+	Scale  int64 `json:"scale"`
+}
+
+// displayMoney возвращает отображаемую сумму как есть или, при moneyObjects, объектом Money с валютой
+func (h *HTTPHandler) displayMoney(v json.Number, currency string) any {
+	if h.moneyObjects {
+		return Money{Amount: string(v), Currency: currency}
+	}
+	return v
+}
+
+// parseScale читает параметр scale, на который делятся отображаемые суммы.
+// Хранимые значения при этом не меняются.
+func parseScale(r *http.Request) (int64, error) {
+	switch r.URL.Query().Get("scale") {
+	case "", "1":
+		return 1, nil
+	case "1000":
+		return 1000, nil
+	case "1000000":
+		return 1000000, nil
+	}
+	return 0, fmt.Errorf("invalid scale: must be 1, 1000 or 1000000")
+}
+
+// parsePrecision читает параметр precision — число знаков после запятой, до которого округляется
+// отображаемый баланс; -1 означает отсутствие параметра. Ограничение сверху зависит от валюты кошелька
+// и применяется в GetWalletHandler.
+func parsePrecision(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("precision")
+	if v == "" {
+		return -1, nil
+	}
+	precision, err := strconv.Atoi(v)
+	if err != nil || precision < 0 {
+		return 0, fmt.Errorf("invalid precision: must be a non-negative integer")
+	}
+	return precision, nil
+}
+
+// parseHistoryFilter читает параметры direction, from и to запроса истории
+func parseHistoryFilter(r *http.Request) (HistoryFilter, error) {
+	var filter HistoryFilter
+	switch direction := r.URL.Query().Get("direction"); direction {
+	case "", "all", "in", "out":
+		filter.Direction = direction
+	default:
+		return HistoryFilter{}, fmt.Errorf("invalid direction: must be in, out or all")
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return HistoryFilter{}, fmt.Errorf("invalid from: must be an RFC 3339 timestamp")
+		}
+		filter.From = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return HistoryFilter{}, fmt.Errorf("invalid to: must be an RFC 3339 timestamp")
+		}
+		filter.To = t
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return HistoryFilter{}, fmt.Errorf("invalid time range: from must be before to")
+	}
+	return filter, nil
+}
+
+// parsePagination читает параметры limit и offset запроса, подставляя limit по умолчанию
+func parsePagination(r *http.Request, defaultLimit, maxLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			return 0, 0, fmt.Errorf("invalid limit: must be between 1 and %d", maxLimit)
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid offset")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// parseWalletSort читает параметры sort и order списка кошельков; отсутствующие параметры берутся из def
+func parseWalletSort(r *http.Request, def WalletSort) (WalletSort, error) {
+	sort := def
+	if v := r.URL.Query().Get("sort"); v != "" {
+		if _, ok := walletSortColumns[v]; !ok {
+			return WalletSort{}, fmt.Errorf("invalid sort: must be id, balance or created_at")
+		}
+		sort.Field = v
+	}
+	switch r.URL.Query().Get("order") {
+	case "":
+	case "asc":
+		sort.Desc = false
+	case "desc":
+		sort.Desc = true
+	default:
+		return WalletSort{}, fmt.Errorf("invalid order: must be asc or desc")
+	}
+	return sort, nil
+}
+
+// checkBatchSize проверяет размер пакетного запроса и отправляет ошибку, если он превышает maxBatchSize
+func (h *HTTPHandler) checkBatchSize(w http.ResponseWriter, r *http.Request, n int) bool {
+	if h.maxBatchSize > 0 && n > h.maxBatchSize {
+		h.responseError(w, r, http.StatusBadRequest, fmt.Sprintf("batch too large: at most %d items allowed", h.maxBatchSize))
+		return false
+	}
+	return true
+}
+
+// decodeJSON разбирает тело запроса в v и отправляет ошибку, если разобрать его не удалось.
+// Используется всеми обработчиками, принимающими JSON.
+//
+// В строгом режиме (по умолчанию) требуется Content-Type: application/json, тело ограничено
+// maxRequestBytes, а неизвестные поля, данные после JSON-документа и отсутствие полей из required
+// отклоняются. Так опечатка в имени поля (например, "amont") или пропущенное поле приводят к 400,
+// а не к молчаливому нулевому значению. Клиентам, которые отправляют JSON без этого заголовка,
+// нужен мягкий режим на время перехода.
+//
+// Мягкий режим сохранен для перехода старых клиентов: Content-Type и размер тела не
+// проверяются, неизвестные поля игнорируются, обязательность полей проверяют только
+// сами обработчики.
+func (h *HTTPHandler) decodeJSON(w http.ResponseWriter, r *http.Request, v any, required ...string) bool {
+	if !h.strictJSON {
+		err := json.NewDecoder(r.Body).Decode(v)
+		switch {
+		case errors.Is(err, ErrInvalidAmount):
+			h.responseError(w, r, http.StatusBadRequest, err.Error())
+			return false
+		case err != nil:
+			h.responseError(w, r, http.StatusBadRequest, "invalid request")
+			return false
+		}
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		h.responseError(w, r, http.StatusUnsupportedMediaType, "content type must be application/json")
+		return false
+	}
+
+	body := http.MaxBytesReader(w, r.Body, h.maxRequestBytes)
+	decoder := json.NewDecoder(body)
+
+	var raw json.RawMessage
+	err = decoder.Decode(&raw)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		h.responseError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large: at most %d bytes allowed", maxBytesErr.Limit))
+		return false
+	case err != nil:
+		h.responseError(w, r, http.StatusBadRequest, "invalid request")
+		return false
+	}
+	if decoder.More() {
+		h.responseError(w, r, http.StatusBadRequest, "invalid request: unexpected data after JSON body")
+		return false
+	}
+
+	// Поле со значением null считается отсутствующим
+	if len(required) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			h.responseError(w, r, http.StatusBadRequest, "invalid request")
+			return false
+		}
+		for _, name := range required {
+			if value, ok := fields[name]; !ok || string(value) == "null" {
+				h.responseError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid request: missing required field %q", name))
+				return false
+			}
+		}
+	}
+
+	strict := json.NewDecoder(bytes.NewReader(raw))
+	strict.DisallowUnknownFields()
+	err = strict.Decode(v)
+	switch {
+	case err != nil && strings.HasPrefix(err.Error(), "json: unknown field "):
+		h.responseError(w, r, http.StatusBadRequest, "invalid request: "+strings.TrimPrefix(err.Error(), "json: "))
+		return false
+	case errors.Is(err, ErrInvalidAmount):
+		h.responseError(w, r, http.StatusBadRequest, err.Error())
+		return false
+	case err != nil:
+		h.responseError(w, r, http.StatusBadRequest, "invalid request")
+		return false
+	}
+	return true
+}
+
+// withCacheControl добавляет заголовок Cache-Control к ответам обработчика, пустое значение ничего не меняет
+func withCacheControl(value string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if value != "" {
+			w.Header().Set("Cache-Control", value)
+		}
+		next(w, r)
+	}
+}
+
+// withWriteDeadline переносит срок записи ответа, заданный WriteTimeout сервера, на timeout от начала
+// обработки, чтобы маршрут с долгим сроком успел отправить ответ; 0 снимает срок записи.
+// Запас в секунду оставляет время на отправку ошибки после истечения срока обработки.
+func withWriteDeadline(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout + time.Second)
+		}
+		err := http.NewResponseController(w).SetWriteDeadline(deadline)
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		}
+		next(w, r)
+	}
+}
+
+// maxResponseBytes ограничивает размер сериализованного JSON-ответа, 0 отключает ограничение
+var maxResponseBytes int64 = 10 << 20
+
+// errResponseTooLarge возвращается limitWriter при превышении maxResponseBytes
+var errResponseTooLarge = errors.New("response too large")
+
+// limitWriter накапливает ответ в буфере и считает байты, отказывая в записи сверх лимита
+type limitWriter struct {
+	buf   bytes.Buffer
+	limit int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.limit > 0 && int64(lw.buf.Len()+len(p)) > lw.limit {
+		return 0, errResponseTooLarge
+	}
+	return lw.buf.Write(p)
+}
+
+func responseJSON(w http.ResponseWriter, status int, data interface{}) {
+	lw := &limitWriter{limit: maxResponseBytes}
+	err := json.NewEncoder(lw).Encode(data)
+	if err != nil {
+		w.Header().Del("Content-Range")
+		w.Header().Set("Content-Type", "application/json")
+		// Запрос корректен, но сервер отказался сериализовать ответ, поэтому это ошибка сервера, а не клиента
+		if errors.Is(err, errResponseTooLarge) {
+			log.Printf("response exceeds MAX_RESPONSE_BYTES (%d bytes)", maxResponseBytes)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "response too large: narrow the request or use limit and offset"})
+			return
+		}
+		log.Printf("failed to encode response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to encode response"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(lw.buf.Len()))
+	w.WriteHeader(status)
+	w.Write(lw.buf.Bytes())
+}
+
+// Problem представляет описание ошибки в формате RFC 7807
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Retryable и RetryAfterMs сообщают клиенту, что запрос можно повторить после паузы
+	Retryable    bool  `json:"retryable,omitempty"`
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+}
+
+// retryableError представляет ответ об ошибке, после которой запрос стоит повторить
+type retryableError struct {
+	Error        string `json:"error"`
+	Retryable    bool   `json:"retryable"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+// problemTypes сопоставляет HTTP-статусы с типами проблем
+var problemTypes = map[int]string{
+	http.StatusBadRequest:          "/problems/invalid-request",
+	http.StatusUnauthorized:        "/problems/unauthorized",
+	http.StatusForbidden:           "/problems/forbidden",
+	http.StatusNotFound:            "/problems/not-found",
+	http.StatusConflict:            "/problems/conflict",
+	http.StatusInternalServerError: "/problems/internal-error",
+	http.StatusServiceUnavailable:  "/problems/temporarily-unavailable",
+	http.StatusGatewayTimeout:      "/problems/timeout",
+}
+
+// responseError отправляет ошибку в формате {"error": ...} либо application/problem+json,
+// если это включено в обработчике или запрошено клиентом через заголовок Accept.
+// Внутренняя ошибка запроса, прерванного по requestTimeout, отправляется как 503 с возможностью повтора.
+func (h *HTTPHandler) responseError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if status == http.StatusInternalServerError && requestTimedOut(r) {
+		h.responseRetryable(w, r, "request timed out", time.Second)
+		return
+	}
+	h.writeError(w, r, status, message, 0)
+}
+
+// responseStoreError отправляет 404 для несуществующего кошелька и 500 для остальных ошибок хранилища,
+// чтобы ошибки клиента не смешивались в мониторинге с отказами базы данных
+func (h *HTTPHandler) responseStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrWalletNotFound) {
+		h.responseError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	h.responseError(w, r, http.StatusInternalServerError, "internal error")
+}
+
+// responseRetryable отправляет 503 с признаком retryable и рекомендуемой паузой перед повтором
+func (h *HTTPHandler) responseRetryable(w http.ResponseWriter, r *http.Request, message string, retryAfter time.Duration) {
+	// Retry-After задается в целых секундах, поэтому округляется вверх
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	h.writeError(w, r, http.StatusServiceUnavailable, message, retryAfter)
+}
+
+// responseTransferTimeout отвечает на перевод, прерванный по таймауту. Транзакция могла успеть
+// зафиксироваться, поэтому без ключа идемпотентности повтор может списать средства дважды:
+// клиент получает 504 без признака retryable и должен сверить историю. С ключом идемпотентности
+// повтор вернет уже проведенный перевод, и ответ помечается как retryable.
+func (h *HTTPHandler) responseTransferTimeout(w http.ResponseWriter, r *http.Request, idempotent bool) {
+	if idempotent {
+		h.responseRetryable(w, r, "transfer timed out, retry with the same Idempotency-Key", time.Second)
+		return
+	}
+	h.writeError(w, r, http.StatusGatewayTimeout, "transfer timed out: outcome unknown, check history before retrying", 0)
+}
+
+func (h *HTTPHandler) writeError(w http.ResponseWriter, r *http.Request, status int, message string, retryAfter time.Duration) {
+	if !h.problemJSON && !strings.Contains(r.Header.Get("Accept"), "application/problem+json") {
+		if retryAfter > 0 {
+			responseJSON(w, status, retryableError{Error: message, Retryable: true, RetryAfterMs: retryAfter.Milliseconds()})
+			return
+		}
+		responseJSON(w, status, map[string]string{"error": message})
+		return
+	}
+
+	problemType, ok := problemTypes[status]
+	if !ok {
+		problemType = "about:blank"
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:         problemType,
+		Title:        http.StatusText(status),
+		Status:       status,
+		Detail:       message,
+		Instance:     r.URL.Path,
+		Retryable:    retryAfter > 0,
+		RetryAfterMs: retryAfter.Milliseconds(),
+	})
+}
+
+// isUniqueViolation проверяет, что ошибка вызвана нарушением уникальности (SQLSTATE 23505)
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isContextError определяет, что операция прервана отменой или истечением контекста запроса,
+// а не отказом базы данных
+func isContextError(r *http.Request, err error) bool {
+	var pqErr *pq.Error
+	return requestTimedOut(r) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+		errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
+
+// isTransientError определяет ошибки базы данных, после которых операцию можно безопасно повторить:
+// конфликты сериализации, взаимоблокировки и проблемы с соединением. Отмена и истечение контекста
+// к ним не относятся: context.DeadlineExceeded реализует net.Error, но прерванная операция могла
+// успеть выполниться.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		if pqErr.Code == "57014" {
+			// query_canceled: запрос отменен вместе с контекстом
+			return false
+		}
+		switch pqErr.Code.Class() {
+		case "08", "53", "57":
+			// connection_exception, insufficient_resources, operator_intervention
+			return true
+		}
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// waitForDB ожидает готовности базы данных, повторяя PingContext с экспоненциальной задержкой
+func waitForDB(db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	delay := 100 * time.Millisecond
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("database is not ready: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database is not ready after %s: %w", timeout, err)
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
+	}
+}
+
+// purgeIdempotencyKeys периодически удаляет просроченные ключи идемпотентности
+func purgeIdempotencyKeys(store *DBStore, interval time.Duration) {
+	for {
+		purged, err := store.PurgeIdempotencyKeys(context.Background())
+		if err != nil {
+			log.Printf("idempotency key purge failed: %v", err)
+		} else if purged > 0 {
+			log.Printf("purged %d expired idempotency keys", purged)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// reconcileTransactionCounts периодически сверяет кэш счетчиков транзакций с историей
+func reconcileTransactionCounts(store *DBStore, interval time.Duration) {
+	for {
+		fixed, err := store.ReconcileTransactionCounts(context.Background())
+		if err != nil {
+			log.Printf("transaction count reconciliation failed: %v", err)
+		} else if fixed > 0 {
+			log.Printf("transaction count reconciliation fixed %d wallets", fixed)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// openDatabase подключается к PostgreSQL, дожидается готовности базы данных и применяет схему
+func openDatabase(dbConfig DBConfig) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dbConfig.DSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(dbConfig.MaxOpenConns)
+	db.SetMaxIdleConns(dbConfig.MaxIdleConns)
+	db.SetConnMaxLifetime(dbConfig.ConnMaxLifetime)
+	log.Printf("database pool: max open %d, max idle %d, max lifetime %s",
+		dbConfig.MaxOpenConns, dbConfig.MaxIdleConns, dbConfig.ConnMaxLifetime)
+
+	err = waitForDB(db, dbConfig.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	// Защиту журнала транзакций от изменений можно отключить, например на время ручной миграции данных
+	immutability := "ENABLE"
+	if !dbConfig.TransactionsImmutable {
+		immutability = "DISABLE"
+		log.Printf("transactions immutability trigger is disabled")
+	}
+	_, err = db.Exec("ALTER TABLE transactions " + immutability + " TRIGGER transactions_immutable")
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// newStore создает хранилище, выбранное в cfg.Store. Для PostgreSQL также запускает фоновое
+// обслуживание и возвращает пул соединений и ленту транзакций, которые нужно закрыть при остановке.
+func newStore(cfg Config) (Store, *sql.DB, *transactionFeed, error) {
+	if cfg.Store == "memory" {
+		memStore := NewMemStore()
+		memStore.storeConfig = cfg.Transfers
+		log.Printf("using in-memory store: data is not persisted")
+		return memStore, nil, nil, nil
+	}
+
+	db, err := openDatabase(cfg.DB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	dbStore := NewDBStore(db)
+	dbStore.storeConfig = cfg.Transfers
+	dbStore.txAttempts = cfg.DB.TxAttempts
+	dbStore.readinessQuery = cfg.DB.ReadinessQuery
+	// Кошельки, созданные до появления валют, получают базовую валюту
+	_, err = db.Exec("UPDATE wallets SET currency = $1 WHERE currency IS NULL", cfg.Transfers.baseCurrency)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	go reconcileTransactionCounts(dbStore, cfg.DB.ReconcileInterval)
+	go purgeIdempotencyKeys(dbStore, time.Hour)
+
+	feed, err := newTransactionFeed(cfg.DB.DSN())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dbStore, db, feed, nil
+}
+
+// newHandler создает обработчик HTTP-запросов над store с настройками из cfg
+func newHandler(cfg Config, store Store) *HTTPHandler {
+	handler := NewHTTPHandler(store)
+	handler.handlerConfig = cfg.Handler
+
+	// Список допустимых валют всегда включает базовую
+	handler.currencies[cfg.Transfers.baseCurrency] = true
+	for _, code := range cfg.Currencies {
+		handler.currencies[code] = true
+	}
+	if cfg.TransferRateLimit > 0 {
+		handler.transferLimiter = newWalletRateLimiter(rate.Limit(cfg.TransferRateLimit), cfg.TransferRateBurst)
+		go handler.transferLimiter.cleanup(time.Minute)
+	}
+
+	if cfg.Auth.Disabled {
+		log.Printf("API key authentication is disabled")
+		return handler
+	}
+	for _, key := range cfg.Auth.Keys {
+		handler.addAPIKey(key, authUser)
+	}
+	for _, key := range cfg.Auth.AdminKeys {
+		handler.addAPIKey(key, authAdmin)
+	}
+	return handler
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to an optional JSON config file with environment variable values")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxResponseBytes = cfg.MaxResponseBytes
+
+	store, db, feed, err := newStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := newHandler(cfg, store)
+	handler.feed = feed
+
+	r := handler.routes()
+
+	// CORS включается списком источников, которым разрешено обращаться к API из браузера
+	var root http.Handler = r
+	cors, err := cfg.CORS.policy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cors != nil {
+		root = cors.handler(r)
+	}
+
+	tlsConfig, err := cfg.Server.tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	server := &http.Server{
+		Addr:              cfg.Server.Addr,
+		TLSConfig:         tlsConfig,
+		Handler:           loggingMiddleware(logger, root),
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	if feed != nil {
+		server.RegisterOnShutdown(feed.close)
+	}
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			fmt.Printf("Server is listening on %s (TLS)...\n", cfg.Server.Addr)
+			// Сертификат уже загружен в TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			fmt.Printf("Server is listening on %s...\n", cfg.Server.Addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("received %s, shutting down", sig)
+
+	// Сервер перестает принимать соединения и дожидается текущих запросов,
+	// и только после этого закрывается пул соединений с базой данных
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+
+	if db != nil {
+		err = db.Close()
+		if err != nil {
+			log.Printf("closing database: %v", err)
+		}
+	}
 
-	port := 8080
-	fmt.Printf("Server is listening on :%d...\n", port)
-	http.ListenAndServe(fmt.Sprintf(":%d", port), r)
+	log.Printf("shutdown completed in %.1f seconds", time.Since(started).Seconds())
 }
@@ -0,0 +1,2625 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// testDBStore подключается к PostgreSQL из TEST_DATABASE_URL и применяет схему. Без переменной
+// тест пропускается. Тесты создают собственные кошельки со случайными ID и не мешают друг другу.
+func testDBStore(t *testing.T) *DBStore {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(schema)
+	if err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	return NewDBStore(db)
+}
+
+// testIsolatedDBStore работает как testDBStore, но в отдельной схеме, которая удаляется после теста.
+// Нужен тестам запросов по всем кошелькам. Пул ограничен одним соединением, чтобы search_path
+// действовал во всех запросах.
+func testIsolatedDBStore(t *testing.T) *DBStore {
+	t.Helper()
+	store := testDBStore(t)
+	store.db.SetMaxOpenConns(1)
+	name := "test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	_, err := store.db.Exec("CREATE SCHEMA " + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Exec("DROP SCHEMA " + name + " CASCADE") })
+	_, err = store.db.Exec("SET search_path TO " + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.db.Exec(schema)
+	if err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	return store
+}
+
+// newTestDBWallet создает кошелек в базе данных с заданным балансом
+func newTestDBWallet(t *testing.T, store *DBStore, balance Amount) *Wallet {
+	t.Helper()
+	wallet, err := store.CreateWallet(context.Background(), "")
+	if err != nil {
+		t.Fatalf("CreateWallet: %v", err)
+	}
+	_, err = store.db.Exec("UPDATE wallets SET balance = $1 WHERE id = $2", balance, wallet.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallet.Balance = balance
+	return wallet
+}
+
+// slowStore задерживает переводы до отмены контекста, имитируя зависший запрос к базе данных
+type slowStore struct {
+	*MemStore
+}
+
+func (s slowStore) Transfer(ctx context.Context, fromID, toID string, amount Amount, opts TransferOptions) (*TransferResult, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// slowHistoryStore отвечает на запрос истории через delay, если контекст не отменен раньше
+type slowHistoryStore struct {
+	*MemStore
+	delay time.Duration
+}
+
+func (s slowHistoryStore) GetHistory(ctx context.Context, walletID string, filter HistoryFilter, limit, offset int) ([]Transaction, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.MemStore.GetHistory(ctx, walletID, filter, limit, offset)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newTestWallet создает кошелек с заданным балансом
+func newTestWallet(t *testing.T, store *MemStore, balance Amount) *Wallet {
+	t.Helper()
+	wallet, err := store.CreateWallet(context.Background(), "")
+	if err != nil {
+		t.Fatalf("CreateWallet: %v", err)
+	}
+	store.wallets[wallet.ID].Balance = balance
+	wallet.Balance = balance
+	return wallet
+}
+
+// walletRequest создает запрос к обработчику кошелька с переменной пути walletId
+func walletRequest(method, target, walletID, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return mux.SetURLVars(r, map[string]string{"walletId": walletID})
+}
+
+// decodeBody разбирает JSON-ответ в map
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var body map[string]any
+	err := json.Unmarshal(rec.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatalf("invalid response body %q: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+func TestTransferTimeout(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+
+	h := NewHTTPHandler(slowStore{store})
+	h.requestTimeout = 10 * time.Millisecond
+	handler := h.timeoutMiddleware(h.requestTimeout, http.HandlerFunc(h.TransferHandler))
+
+	tests := []struct {
+		name           string
+		idempotencyKey string
+		wantStatus     int
+		wantRetryable  bool
+	}{
+		// Без ключа идемпотентности повтор может провести перевод дважды
+		{name: "without idempotency key", wantStatus: http.StatusGatewayTimeout},
+		{name: "with idempotency key", idempotencyKey: "key-1", wantStatus: http.StatusServiceUnavailable, wantRetryable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"10.00"}`)
+			if tt.idempotencyKey != "" {
+				r.Header.Set("Idempotency-Key", tt.idempotencyKey)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			retryable, _ := decodeBody(t, rec)["retryable"].(bool)
+			if retryable != tt.wantRetryable {
+				t.Errorf("retryable = %v, want %v", retryable, tt.wantRetryable)
+			}
+			if got := rec.Header().Get("Retry-After") != ""; got != tt.wantRetryable {
+				t.Errorf("Retry-After present = %v, want %v", got, tt.wantRetryable)
+			}
+		})
+	}
+}
+
+func TestIsTransientErrorContext(t *testing.T) {
+	for _, err := range []error{context.DeadlineExceeded, context.Canceled} {
+		if isTransientError(err) {
+			t.Errorf("isTransientError(%v) = true, want false", err)
+		}
+	}
+}
+
+func TestCallerIdentity(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/wallet", nil)
+	r.RemoteAddr = "10.0.0.1:5123"
+	if got := callerIdentity(r); got != "anonymous@10.0.0.1:5123" {
+		t.Errorf("callerIdentity without key = %q", got)
+	}
+
+	r.Header.Set("Authorization", "Bearer secret-key")
+	got := callerIdentity(r)
+	if !strings.HasPrefix(got, "key:") || !strings.HasSuffix(got, "@10.0.0.1:5123") {
+		t.Errorf("callerIdentity with key = %q", got)
+	}
+	if strings.Contains(got, "secret-key") {
+		t.Errorf("callerIdentity leaks the API key: %q", got)
+	}
+
+	// Разные ключи одного клиента различимы в журнале
+	r.Header.Set("Authorization", "Bearer other-key")
+	if other := callerIdentity(r); other == got {
+		t.Errorf("callerIdentity is the same for different keys: %q", got)
+	}
+}
+
+// lastAuditEntry возвращает последнюю запись журнала аудита по кошельку
+func lastAuditEntry(t *testing.T, store *DBStore, walletID string) AuditEntry {
+	t.Helper()
+	entries, err := store.ListAudit(context.Background(), walletID, 1)
+	if err != nil {
+		t.Fatalf("ListAudit: %v", err)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("no audit entries for wallet %s", walletID)
+	}
+	return entries[0]
+}
+
+func TestAuditRejectedRequest(t *testing.T) {
+	store := testDBStore(t)
+	from := newTestDBWallet(t, store, 100_00)
+	to := newTestDBWallet(t, store, 0)
+
+	h := NewHTTPHandler(store)
+	h.addAPIKey("user-key", authUser)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", strings.NewReader(`{"to":"`+to.ID+`","amount":"10.00"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer wrong-key")
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	entry := lastAuditEntry(t, store, from.ID)
+	if entry.Status != http.StatusUnauthorized || !strings.HasPrefix(entry.Caller, "key:") {
+		t.Errorf("audit entry = %+v, want status 401 with a key identifier", entry)
+	}
+}
+
+func TestUpdateWalletBalance(t *testing.T) {
+	store := testDBStore(t)
+	store.overdraftLimit = 10_00
+	ctx := context.Background()
+
+	wallet := newTestDBWallet(t, store, 5_00)
+	current, err := store.GetWallet(ctx, wallet.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := store.UpdateWalletBalance(ctx, wallet.ID, current.Version, -15_00)
+	if err != nil {
+		t.Fatalf("UpdateWalletBalance within the overdraft limit: %v", err)
+	}
+	if updated.Balance != -10_00 || updated.Version != current.Version+1 {
+		t.Errorf("wallet = %+v, want balance -10.00 and version %d", updated, current.Version+1)
+	}
+
+	_, err = store.UpdateWalletBalance(ctx, wallet.ID, current.Version, 1_00)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("stale version: err = %v, want ErrVersionConflict", err)
+	}
+	_, err = store.UpdateWalletBalance(ctx, wallet.ID, updated.Version, -1)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("below the overdraft limit: err = %v, want ErrInsufficientFunds", err)
+	}
+
+	err = store.DeactivateWallet(ctx, wallet.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inactive, err := store.GetWallet(ctx, wallet.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UpdateWalletBalance(ctx, wallet.ID, inactive.Version, 1_00)
+	if !errors.Is(err, ErrWalletInactive) {
+		t.Errorf("inactive wallet: err = %v, want ErrWalletInactive", err)
+	}
+
+	_, err = store.UpdateWalletBalance(ctx, "00000000-0000-0000-0000-000000000000", 0, 1_00)
+	if !errors.Is(err, ErrWalletNotFound) {
+		t.Errorf("missing wallet: err = %v, want ErrWalletNotFound", err)
+	}
+}
+
+func TestGetWalletPrecisionClampedToCurrency(t *testing.T) {
+	store := NewMemStore()
+	h := NewHTTPHandler(store)
+
+	tests := []struct {
+		currency string
+		balance  Amount
+		query    string
+		want     string
+	}{
+		{currency: "USD", balance: 12_34, query: "?precision=5", want: "12.34"},
+		{currency: "USD", balance: 12_35, query: "?precision=1", want: "12.4"},
+		{currency: "JPY", balance: 1234_00, query: "?precision=2", want: "1234"},
+		{currency: "JPY", balance: 1234_00, query: "?precision=0", want: "1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.currency+tt.query, func(t *testing.T) {
+			wallet, err := store.CreateWallet(context.Background(), tt.currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.wallets[wallet.ID].Balance = tt.balance
+
+			rec := httptest.NewRecorder()
+			h.GetWalletHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+wallet.ID+tt.query, wallet.ID, ""))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+			var body struct {
+				Balance json.Number `json:"balance"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if string(body.Balance) != tt.want {
+				t.Errorf("balance = %s, want %s", body.Balance, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileTransactionCounts(t *testing.T) {
+	store := testDBStore(t)
+	ctx := context.Background()
+
+	from := newTestDBWallet(t, store, 100_00)
+	to := newTestDBWallet(t, store, 0)
+	for i := 0; i < 3; i++ {
+		_, err := store.Transfer(ctx, from.ID, to.ID, 1_00, TransferOptions{})
+		if err != nil {
+			t.Fatalf("Transfer: %v", err)
+		}
+	}
+
+	// Имитируем расхождение кэша с историей
+	_, err := store.db.Exec("UPDATE wallets SET transaction_count = 7 WHERE id = $1", from.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.db.Exec("UPDATE wallets SET transaction_count = 0 WHERE id = $1", to.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, err := store.ReconcileTransactionCounts(ctx)
+	if err != nil {
+		t.Fatalf("ReconcileTransactionCounts: %v", err)
+	}
+	if fixed < 2 {
+		t.Errorf("fixed = %d, want at least 2", fixed)
+	}
+	for _, id := range []string{from.ID, to.ID} {
+		count, err := store.CountHistory(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 {
+			t.Errorf("transaction_count of %s = %d, want 3", id, count)
+		}
+	}
+}
+
+// Перевод на кошелек с выводом излишка блокирует цель вывода вместе с участниками, поэтому встречные переводы
+// с участием цели не приводят к взаимоблокировке даже без повторов транзакций
+func TestSweepLocksTargetUpFront(t *testing.T) {
+	store := testDBStore(t)
+	store.txAttempts = 1
+	ctx := context.Background()
+
+	sender := newTestDBWallet(t, store, 1000_00)
+	swept := newTestDBWallet(t, store, 0)
+	target := newTestDBWallet(t, store, 1000_00)
+	err := store.SetSweep(ctx, SweepConfig{WalletID: swept.ID, Threshold: 0, Target: target.ID})
+	if err != nil {
+		t.Fatalf("SetSweep: %v", err)
+	}
+
+	const transfers = 20
+	errs := make(chan error, 2*transfers)
+	for i := 0; i < transfers; i++ {
+		go func() {
+			_, err := store.Transfer(ctx, sender.ID, swept.ID, 1_00, TransferOptions{})
+			errs <- err
+		}()
+		go func() {
+			_, err := store.Transfer(ctx, target.ID, sender.ID, 1_00, TransferOptions{})
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2*transfers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Transfer: %v", err)
+		}
+	}
+
+	want := map[string]Amount{sender.ID: 1000_00, swept.ID: 0, target.ID: 1000_00}
+	for id, balance := range want {
+		wallet, err := store.GetWallet(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wallet.Balance != balance {
+			t.Errorf("balance of %s = %s, want %s", id, wallet.Balance, balance)
+		}
+	}
+}
+
+// Расхождение внутри истории обнаруживается, даже если итоговый баланс сходится с сохраненным
+func TestReplayBalanceFirstDivergence(t *testing.T) {
+	store := testDBStore(t)
+	ctx := context.Background()
+
+	wallet := newTestDBWallet(t, store, 0)
+	other := newTestDBWallet(t, store, 0)
+	// Записи в обход перевода: сначала списание без средств, затем компенсирующее зачисление
+	var firstID int64
+	err := store.db.QueryRow("INSERT INTO transactions (from_wallet, to_wallet, amount) VALUES ($1, $2, $3) RETURNING id",
+		wallet.ID, other.ID, Amount(50_00)).Scan(&firstID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.db.Exec("INSERT INTO transactions (from_wallet, to_wallet, amount) VALUES ($1, $2, $3)", other.ID, wallet.ID, Amount(50_00))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := store.ReplayBalance(ctx, wallet.ID)
+	if err != nil {
+		t.Fatalf("ReplayBalance: %v", err)
+	}
+	if replay.Divergence != 0 {
+		t.Errorf("Divergence = %s, want 0", replay.Divergence)
+	}
+	if replay.FirstDivergence == nil || replay.FirstDivergence.TransactionID != firstID || replay.FirstDivergence.Balance != -50_00 {
+		t.Fatalf("FirstDivergence = %+v, want transaction %d with balance -50.00", replay.FirstDivergence, firstID)
+	}
+	if replay.Consistent {
+		t.Error("Consistent = true, want false")
+	}
+
+	// В пределах овердрафта такой баланс допустим
+	store.overdraftLimit = 50_00
+	replay, err = store.ReplayBalance(ctx, wallet.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.FirstDivergence != nil || !replay.Consistent {
+		t.Errorf("replay within the overdraft limit = %+v, want consistent", replay)
+	}
+}
+
+func TestDecodeJSONStrict(t *testing.T) {
+	const jsonType = "application/json"
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		wantStatus  int
+	}{
+		{name: "valid", body: `{"to":"a","amount":"1.00"}`, contentType: jsonType, wantStatus: http.StatusOK},
+		{name: "content type with charset", body: `{"to":"a","amount":"1.00"}`, contentType: "application/json; charset=utf-8", wantStatus: http.StatusOK},
+		{name: "no content type", body: `{"to":"a","amount":"1.00"}`, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "other content type", body: `{"to":"a","amount":"1.00"}`, contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "unknown field", body: `{"to":"a","amont":"1.00"}`, contentType: jsonType, wantStatus: http.StatusBadRequest},
+		{name: "missing required field", body: `{"to":"a"}`, contentType: jsonType, wantStatus: http.StatusBadRequest},
+		{name: "null required field", body: `{"to":"a","amount":null}`, contentType: jsonType, wantStatus: http.StatusBadRequest},
+		{name: "trailing data", body: `{"to":"a","amount":"1.00"} {}`, contentType: jsonType, wantStatus: http.StatusBadRequest},
+		{name: "body too large", body: `{"to":"` + strings.Repeat("a", 100) + `","amount":"1.00"}`, contentType: jsonType, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHTTPHandler(NewMemStore())
+			h.maxRequestBytes = 64
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			var request struct {
+				To     string `json:"to"`
+				Amount Amount `json:"amount"`
+			}
+			if h.decodeJSON(rec, r, &request, "to", "amount") {
+				rec.WriteHeader(http.StatusOK)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDecodeJSONLenient(t *testing.T) {
+	h := NewHTTPHandler(NewMemStore())
+	h.strictJSON = false
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"to":"a","amont":"1.00"}`))
+	rec := httptest.NewRecorder()
+	var request struct {
+		To     string `json:"to"`
+		Amount Amount `json:"amount"`
+	}
+	if !h.decodeJSON(rec, r, &request, "to", "amount") {
+		t.Fatalf("lenient decodeJSON rejected the body: %s", rec.Body.String())
+	}
+	if request.To != "a" || request.Amount != 0 {
+		t.Errorf("request = %+v", request)
+	}
+}
+
+func TestAmountScaleInBody(t *testing.T) {
+	store := NewMemStore()
+	h := NewHTTPHandler(store)
+	from := newTestWallet(t, store, 2000_00)
+	to := newTestWallet(t, store, 0)
+	_, err := store.Transfer(context.Background(), from.ID, to.ID, 1500_00, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.GetWalletHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+to.ID+"?scale=1000", to.ID, ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wallet status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var wallet struct {
+		Balance json.Number `json:"balance"`
+		Scale   int64       `json:"scale"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &wallet)
+	if wallet.Balance != "1.50000" || wallet.Scale != 1000 {
+		t.Errorf("wallet balance = %s, scale = %d, want 1.50000 and 1000", wallet.Balance, wallet.Scale)
+	}
+	if got := rec.Header().Get("X-Amount-Scale"); got != "1000" {
+		t.Errorf("X-Amount-Scale = %q, want 1000", got)
+	}
+
+	rec = httptest.NewRecorder()
+	h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+to.ID+"/history?scale=1000000", to.ID, ""))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("history status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var history []struct {
+		Amount json.Number `json:"amount"`
+		Scale  int64       `json:"scale"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &history)
+	if len(history) != 1 || history[0].Amount != "0.00150000" || history[0].Scale != 1000000 {
+		t.Errorf("history = %+v, want one transaction of 0.00150000 at scale 1000000", history)
+	}
+
+	// Без параметра в теле указывается масштаб 1, хранимые суммы не меняются
+	rec = httptest.NewRecorder()
+	h.GetWalletHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+to.ID, to.ID, ""))
+	json.Unmarshal(rec.Body.Bytes(), &wallet)
+	if wallet.Balance != "1500.00" || wallet.Scale != 1 {
+		t.Errorf("wallet balance = %s, scale = %d, want 1500.00 and 1", wallet.Balance, wallet.Scale)
+	}
+}
+
+// Один ключ идемпотентности на двух кошельках проводит два перевода, если ключи действуют в пределах
+// кошелька, и один, если в пределах вызывающего
+func TestIdempotencyScope(t *testing.T) {
+	for _, perCaller := range []bool{false, true} {
+		store := NewMemStore()
+		store.idempotencyPerCaller = perCaller
+		first := newTestWallet(t, store, 100_00)
+		second := newTestWallet(t, store, 100_00)
+		to := newTestWallet(t, store, 0)
+		checkIdempotencyScope(t, store, first.ID, second.ID, to.ID, perCaller)
+	}
+}
+
+func TestIdempotencyScopeDB(t *testing.T) {
+	for _, perCaller := range []bool{false, true} {
+		store := testDBStore(t)
+		store.idempotencyPerCaller = perCaller
+		first := newTestDBWallet(t, store, 100_00)
+		second := newTestDBWallet(t, store, 100_00)
+		to := newTestDBWallet(t, store, 0)
+		checkIdempotencyScope(t, store, first.ID, second.ID, to.ID, perCaller)
+	}
+}
+
+func checkIdempotencyScope(t *testing.T, store Store, firstID, secondID, toID string, perCaller bool) {
+	t.Helper()
+	ctx := context.Background()
+	opts := TransferOptions{IdempotencyKey: "key-" + uuid.New().String(), Caller: "key:0123456789abcdef"}
+
+	_, err := store.Transfer(ctx, firstID, toID, 10_00, opts)
+	if err != nil {
+		t.Fatalf("first transfer: %v", err)
+	}
+	result, err := store.Transfer(ctx, secondID, toID, 10_00, opts)
+	if err != nil {
+		t.Fatalf("second transfer: %v", err)
+	}
+	if result.Replayed != perCaller {
+		t.Errorf("per caller %v: second transfer replayed = %v", perCaller, result.Replayed)
+	}
+
+	second, err := store.GetWallet(ctx, secondID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Amount(90_00)
+	if perCaller {
+		want = 100_00
+	}
+	if second.Balance != want {
+		t.Errorf("per caller %v: second wallet balance = %s, want %s", perCaller, second.Balance, want)
+	}
+}
+
+func TestReadinessQuery(t *testing.T) {
+	store := testDBStore(t)
+	h := NewHTTPHandler(store)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{query: "", wantStatus: http.StatusOK},
+		{query: "SELECT 1 FROM wallets LIMIT 1", wantStatus: http.StatusOK},
+		{query: "SELECT 1 FROM missing_sentinel_table LIMIT 1", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		store.readinessQuery = tt.query
+		rec := httptest.NewRecorder()
+		h.ReadyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("query %q: status = %d, want %d: %s", tt.query, rec.Code, tt.wantStatus, rec.Body.String())
+		}
+	}
+}
+
+func TestParseWalletSort(t *testing.T) {
+	def := WalletSort{Field: "created_at", Desc: true}
+	tests := []struct {
+		query   string
+		want    WalletSort
+		orderBy string
+	}{
+		{query: "", want: def, orderBy: "created_at DESC, id DESC"},
+		{query: "?sort=id", want: WalletSort{Field: "id", Desc: true}, orderBy: "id DESC"},
+		{query: "?sort=id&order=asc", want: WalletSort{Field: "id"}, orderBy: "id ASC"},
+		{query: "?sort=balance&order=asc", want: WalletSort{Field: "balance"}, orderBy: "balance ASC, id ASC"},
+		{query: "?sort=balance&order=desc", want: WalletSort{Field: "balance", Desc: true}, orderBy: "balance DESC, id DESC"},
+		{query: "?sort=created_at&order=asc", want: WalletSort{Field: "created_at"}, orderBy: "created_at ASC, id ASC"},
+	}
+	for _, tt := range tests {
+		got, err := parseWalletSort(httptest.NewRequest(http.MethodGet, "/api/v1/wallets"+tt.query, nil), def)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: sort = %+v, want %+v", tt.query, got, tt.want)
+		}
+		if orderBy, _ := got.orderBy(); orderBy != tt.orderBy {
+			t.Errorf("%q: ORDER BY %q, want %q", tt.query, orderBy, tt.orderBy)
+		}
+	}
+
+	for _, query := range []string{"?sort=currency", "?sort=id%3BDROP%20TABLE%20wallets", "?order=up"} {
+		_, err := parseWalletSort(httptest.NewRequest(http.MethodGet, "/api/v1/wallets"+query, nil), def)
+		if err == nil {
+			t.Errorf("%q accepted, want error", query)
+		}
+	}
+	if _, err := (WalletSort{Field: "version"}).orderBy(); err == nil {
+		t.Error("orderBy accepted a field outside the allowlist")
+	}
+}
+
+func TestListWalletsSort(t *testing.T) {
+	store := testDBStore(t)
+	ctx := context.Background()
+	for i, balance := range []Amount{30_00, 10_00, 20_00} {
+		wallet := newTestDBWallet(t, store, balance)
+		// Каждый следующий кошелек создан раньше предыдущего, поэтому порядок по created_at не совпадает с порядком создания
+		_, err := store.db.Exec("UPDATE wallets SET created_at = now() - $1 * interval '1 minute' WHERE id = $2", i, wallet.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created := make(map[string]time.Time)
+	rows, err := store.db.Query("SELECT id, created_at FROM wallets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id string
+		var at time.Time
+		if err := rows.Scan(&id, &at); err != nil {
+			t.Fatal(err)
+		}
+		created[id] = at
+	}
+	rows.Close()
+
+	// less сравнивает кошельки по полю сортировки и затем по ID
+	less := map[string]func(a, b Wallet) bool{
+		"id":      func(a, b Wallet) bool { return a.ID < b.ID },
+		"balance": func(a, b Wallet) bool { return a.Balance < b.Balance || a.Balance == b.Balance && a.ID < b.ID },
+		"created_at": func(a, b Wallet) bool {
+			return created[a.ID].Before(created[b.ID]) || created[a.ID].Equal(created[b.ID]) && a.ID < b.ID
+		},
+	}
+	for field, less := range less {
+		for _, desc := range []bool{false, true} {
+			page, err := store.ListWallets(ctx, WalletSort{Field: field, Desc: desc}, 1000, 0)
+			if err != nil {
+				t.Fatalf("ListWallets(%s, desc %v): %v", field, desc, err)
+			}
+			for i := 1; i < len(page.Wallets); i++ {
+				a, b := page.Wallets[i-1], page.Wallets[i]
+				if desc {
+					a, b = b, a
+				}
+				if !less(a, b) {
+					t.Fatalf("sort %s desc %v: %s listed before %s", field, desc, page.Wallets[i-1].ID, page.Wallets[i].ID)
+				}
+			}
+		}
+	}
+}
+
+// Медленное чтение истории прерывается по requestTimeout, а выгрузка того же маршрута получает exportTimeout
+func TestExportRouteTimeout(t *testing.T) {
+	store := NewMemStore()
+	wallet := newTestWallet(t, store, 100_00)
+	h := NewHTTPHandler(slowHistoryStore{MemStore: store, delay: 50 * time.Millisecond})
+	h.requestTimeout = 10 * time.Millisecond
+	h.exportTimeout = time.Second
+	router := h.routes()
+
+	tests := []struct {
+		query      string
+		wantStatus int
+	}{
+		{query: "", wantStatus: http.StatusServiceUnavailable},
+		{query: "?format=json", wantStatus: http.StatusServiceUnavailable},
+		{query: "?format=ofx", wantStatus: http.StatusOK},
+		{query: "?format=qif", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/wallet/"+wallet.ID+"/history"+tt.query, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%q: status = %d, want %d: %s", tt.query, rec.Code, tt.wantStatus, rec.Body.String())
+		}
+	}
+}
+
+// Выгрузка дольше WriteTimeout сервера доходит до клиента, а обычный ответ после срока записи обрывается
+func TestExportOutlivesWriteTimeout(t *testing.T) {
+	store := NewMemStore()
+	wallet := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+	_, err := store.Transfer(context.Background(), wallet.ID, to.ID, 1_00, TransferOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPHandler(slowHistoryStore{MemStore: store, delay: 200 * time.Millisecond})
+	h.requestTimeout = time.Second
+	h.exportTimeout = time.Second
+
+	srv := httptest.NewUnstartedServer(h.routes())
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{query: "?format=ofx"},
+		{query: "?format=qif"},
+		{query: "?format=json", wantErr: true},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + "/api/v1/wallet/" + wallet.ID + "/history" + tt.query)
+		if err == nil {
+			var body []byte
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode != http.StatusOK {
+				t.Errorf("%s: status = %d: %s", tt.query, resp.StatusCode, body)
+			}
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.query, err, tt.wantErr)
+		}
+	}
+}
+
+// Ответ перевода с комиссией раскладывает его на сумму, комиссию и итоговое списание
+func TestTransferResultBreakdown(t *testing.T) {
+	store := NewMemStore()
+	store.fees = FeePolicy{Flat: 1_00}
+	checkTransferResultBreakdown(t, store, newTestWallet(t, store, 100_00).ID, newTestWallet(t, store, 0).ID)
+
+	data, err := json.Marshal(&TransferResult{Amount: 10_00, Fee: 1_00, TotalDebited: 11_00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"amount":10.00`, `"fee":1.00`, `"total_debited":11.00`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("response %s has no %s", data, field)
+		}
+	}
+}
+
+func TestTransferResultBreakdownDB(t *testing.T) {
+	store := testDBStore(t)
+	store.fees = FeePolicy{Flat: 1_00}
+	checkTransferResultBreakdown(t, store, newTestDBWallet(t, store, 100_00).ID, newTestDBWallet(t, store, 0).ID)
+}
+
+func checkTransferResultBreakdown(t *testing.T, store Store, fromID, toID string) {
+	t.Helper()
+	tests := []struct {
+		payer        string
+		wantDebited  Amount
+		wantBalance  Amount
+		wantReceived Amount
+	}{
+		{payer: FeePayerSender, wantDebited: 11_00, wantBalance: 89_00, wantReceived: 10_00},
+		{payer: FeePayerRecipient, wantDebited: 10_00, wantBalance: 79_00, wantReceived: 19_00},
+	}
+	for _, tt := range tests {
+		result, err := store.Transfer(context.Background(), fromID, toID, 10_00, TransferOptions{FeePayer: tt.payer})
+		if err != nil {
+			t.Fatalf("%s pays: Transfer: %v", tt.payer, err)
+		}
+		if result.Amount != 10_00 || result.Fee != 1_00 || result.TotalDebited != tt.wantDebited {
+			t.Errorf("%s pays: amount %s, fee %s, total debited %s, want 10.00, 1.00, %s",
+				tt.payer, result.Amount, result.Fee, result.TotalDebited, tt.wantDebited)
+		}
+		if result.BalanceBefore-result.BalanceAfter != result.TotalDebited || result.BalanceAfter != tt.wantBalance {
+			t.Errorf("%s pays: balance %s -> %s does not match total debited %s", tt.payer, result.BalanceBefore, result.BalanceAfter, result.TotalDebited)
+		}
+		if result.RecipientBalanceAfter != tt.wantReceived {
+			t.Errorf("%s pays: recipient balance %s, want %s", tt.payer, result.RecipientBalanceAfter, tt.wantReceived)
+		}
+	}
+}
+
+// checkSplitFeeRecords проверяет, что перевод с комиссией записан двумя связанными строками,
+// которые вместе дают те же изменения балансов, что и одна строка с комиссией
+func checkSplitFeeRecords(t *testing.T, result *TransferResult, history []Transaction) {
+	t.Helper()
+	principal, fee := result.Transaction, result.FeeTransaction
+	if fee == nil {
+		t.Fatal("FeeTransaction is missing")
+	}
+	if principal.GroupID == "" || principal.GroupID != fee.GroupID {
+		t.Errorf("group IDs %q and %q, want the same non-empty ID", principal.GroupID, fee.GroupID)
+	}
+	if principal.Amount != 10_00 || principal.Fee != 0 || fee.Amount != 0 || fee.Fee != 1_00 {
+		t.Errorf("principal %s + %s, fee record %s + %s, want 10.00 + 0 and 0 + 1.00", principal.Amount, principal.Fee, fee.Amount, fee.Fee)
+	}
+
+	found := make(map[int64]bool)
+	var debited Amount
+	for _, transaction := range history {
+		if transaction.GroupID == principal.GroupID {
+			found[transaction.ID] = true
+			debited += transaction.debit()
+		}
+	}
+	if !found[principal.ID] || !found[fee.ID] || len(found) != 2 {
+		t.Errorf("history has rows %v of group %s, want %d and %d", found, principal.GroupID, principal.ID, fee.ID)
+	}
+	if debited != result.TotalDebited {
+		t.Errorf("rows debit %s in total, want %s", debited, result.TotalDebited)
+	}
+}
+
+func TestSplitFeeRecords(t *testing.T) {
+	store := NewMemStore()
+	store.fees = FeePolicy{Flat: 1_00}
+	store.splitFees = true
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+	ctx := context.Background()
+
+	result, err := store.Transfer(ctx, from.ID, to.ID, 10_00, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	history, err := store.GetHistory(ctx, from.ID, HistoryFilter{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSplitFeeRecords(t, result, history)
+	if result.BalanceAfter != 89_00 || result.RecipientBalanceAfter != 10_00 {
+		t.Errorf("balances %s and %s, want 89.00 and 10.00", result.BalanceAfter, result.RecipientBalanceAfter)
+	}
+
+	// Без комиссии перевод записывается одной строкой
+	store.fees = FeePolicy{}
+	result, err = store.Transfer(ctx, from.ID, to.ID, 10_00, TransferOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FeeTransaction != nil || result.Transaction.GroupID != "" {
+		t.Errorf("transfer without a fee was split: %+v", result)
+	}
+}
+
+func TestSplitFeeRecordsDB(t *testing.T) {
+	store := testDBStore(t)
+	store.fees = FeePolicy{Flat: 1_00}
+	store.splitFees = true
+	ctx := context.Background()
+	from := newTestDBWallet(t, store, 100_00)
+	to := newTestDBWallet(t, store, 0)
+	_, err := store.db.Exec("UPDATE wallets SET initial_balance = balance WHERE id IN ($1, $2)", from.ID, to.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := store.Transfer(ctx, from.ID, to.ID, 10_00, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	history, err := store.GetHistory(ctx, from.ID, HistoryFilter{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSplitFeeRecords(t, result, history)
+
+	// Обе строки сходятся с балансами и кэшем счетчиков транзакций
+	for _, id := range []string{from.ID, to.ID} {
+		replay, err := store.ReplayBalance(ctx, id)
+		if err != nil {
+			t.Fatalf("ReplayBalance: %v", err)
+		}
+		if !replay.Consistent {
+			t.Errorf("replay of %s = %+v, want consistent", id, replay)
+		}
+		count, err := store.CountHistory(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("transaction count of %s = %d, want 2", id, count)
+		}
+	}
+	recipients, err := store.Recipients(ctx, from.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0].Count != 1 {
+		t.Errorf("recipients = %+v, want one transfer to %s", recipients, to.ID)
+	}
+}
+
+func TestMoneyFormat(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+	_, err := store.Transfer(context.Background(), from.ID, to.ID, 12_50, TransferOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		moneyObjects bool
+		wantBalance  string
+		wantAmount   string
+	}{
+		{moneyObjects: false, wantBalance: `87.50`, wantAmount: `12.50`},
+		{moneyObjects: true, wantBalance: `{"amount":"87.50","currency":"USD"}`, wantAmount: `{"amount":"12.50","currency":"USD"}`},
+	}
+	for _, tt := range tests {
+		h := NewHTTPHandler(store)
+		h.moneyObjects = tt.moneyObjects
+
+		rec := httptest.NewRecorder()
+		h.GetWalletHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID, from.ID, ""))
+		var wallet struct {
+			Balance json.RawMessage `json:"balance"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &wallet)
+		if string(wallet.Balance) != tt.wantBalance {
+			t.Errorf("money objects %v: balance = %s, want %s", tt.moneyObjects, wallet.Balance, tt.wantBalance)
+		}
+
+		rec = httptest.NewRecorder()
+		h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID+"/history", from.ID, ""))
+		var history []struct {
+			Amount json.RawMessage `json:"amount"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &history)
+		if len(history) != 1 || string(history[0].Amount) != tt.wantAmount {
+			t.Errorf("money objects %v: history = %s, want amount %s", tt.moneyObjects, rec.Body.String(), tt.wantAmount)
+		}
+	}
+}
+
+func TestCurrencyTotals(t *testing.T) {
+	store := testDBStore(t)
+	ctx := context.Background()
+
+	totals := func() map[string]CurrencyTotal {
+		t.Helper()
+		list, err := store.CurrencyTotals(ctx)
+		if err != nil {
+			t.Fatalf("CurrencyTotals: %v", err)
+		}
+		byCurrency := make(map[string]CurrencyTotal)
+		for _, total := range list {
+			byCurrency[total.Currency] = total
+		}
+		return byCurrency
+	}
+
+	before := totals()
+	wallets := []struct {
+		currency string
+		balance  Amount
+	}{
+		{currency: "EUR", balance: 10_00},
+		{currency: "EUR", balance: 25_50},
+		{currency: "JPY", balance: 1000_00},
+	}
+	for _, w := range wallets {
+		wallet, err := store.CreateWallet(ctx, w.currency)
+		if err != nil {
+			t.Fatalf("CreateWallet: %v", err)
+		}
+		_, err = store.db.Exec("UPDATE wallets SET balance = $1 WHERE id = $2", w.balance, wallet.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := totals()
+
+	want := map[string]CurrencyTotal{
+		"EUR": {WalletCount: 2, TotalBalance: 35_50},
+		"JPY": {WalletCount: 1, TotalBalance: 1000_00},
+	}
+	for currency, delta := range want {
+		gotCount := after[currency].WalletCount - before[currency].WalletCount
+		gotBalance := after[currency].TotalBalance - before[currency].TotalBalance
+		if gotCount != delta.WalletCount || gotBalance != delta.TotalBalance {
+			t.Errorf("%s: %d wallets and %s added, want %d and %s", currency, gotCount, gotBalance, delta.WalletCount, delta.TotalBalance)
+		}
+	}
+}
+
+// insertTestTransaction записывает транзакцию в журнал напрямую с заданным временем, не меняя балансы
+func insertTestTransaction(t *testing.T, store *DBStore, fromID, toID string, amount Amount, at time.Time) int64 {
+	t.Helper()
+	var id int64
+	err := store.db.QueryRow("INSERT INTO transactions (time, from_wallet, to_wallet, amount) VALUES ($1, $2, $3, $4) RETURNING id",
+		at, fromID, toID, amount).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestBalanceSeries(t *testing.T) {
+	store := testDBStore(t)
+	wallet := newTestDBWallet(t, store, 50_00)
+	other := newTestDBWallet(t, store, 0)
+	day := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	insertTestTransaction(t, store, other.ID, wallet.ID, 100_00, day)
+	insertTestTransaction(t, store, wallet.ID, other.ID, 30_00, day.AddDate(0, 0, 2))
+	insertTestTransaction(t, store, wallet.ID, other.ID, 15_00, day.AddDate(0, 0, 4))
+	insertTestTransaction(t, store, wallet.ID, other.ID, 5_00, day.AddDate(0, 0, 4).Add(time.Hour))
+
+	series, err := store.BalanceSeries(context.Background(), wallet.ID, "day")
+	if err != nil {
+		t.Fatalf("BalanceSeries: %v", err)
+	}
+	want := []Amount{100_00, 70_00, 50_00}
+	if len(series) != len(want) {
+		t.Fatalf("series = %+v, want %d points", series, len(want))
+	}
+	for i, point := range series {
+		if point.Balance != want[i] {
+			t.Errorf("point %d balance = %s, want %s", i, point.Balance, want[i])
+		}
+		if i > 0 && !point.Time.After(series[i-1].Time) {
+			t.Errorf("point %d at %s is not after %s", i, point.Time, series[i-1].Time)
+		}
+	}
+
+	_, err = store.BalanceSeries(context.Background(), wallet.ID, "minute")
+	if !errors.Is(err, ErrInvalidInterval) {
+		t.Errorf("interval minute: error = %v, want ErrInvalidInterval", err)
+	}
+	_, err = store.BalanceSeries(context.Background(), uuid.New().String(), "day")
+	if !errors.Is(err, ErrWalletNotFound) {
+		t.Errorf("missing wallet: error = %v, want ErrWalletNotFound", err)
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	store := NewMemStore()
+	missing := uuid.New().String()
+
+	tests := []struct {
+		name        string
+		problemJSON bool
+		accept      string
+		wantProblem bool
+	}{
+		{name: "default", wantProblem: false},
+		{name: "accept header", accept: "application/problem+json", wantProblem: true},
+		{name: "config", problemJSON: true, wantProblem: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHTTPHandler(store)
+			h.problemJSON = tt.problemJSON
+			r := walletRequest(http.MethodGet, "/api/v1/wallet/"+missing, missing, "")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.GetWalletHandler(rec, r)
+
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+			}
+			body := decodeBody(t, rec)
+			if !tt.wantProblem {
+				if _, ok := body["error"].(string); !ok {
+					t.Errorf("body = %v, want an error field", body)
+				}
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", got)
+			}
+			if body["type"] != "/problems/not-found" || body["title"] != "Not Found" || body["status"] != float64(http.StatusNotFound) ||
+				body["detail"] == "" || body["instance"] != "/api/v1/wallet/"+missing {
+				t.Errorf("problem = %v", body)
+			}
+		})
+	}
+}
+
+// Статус без собственного типа проблемы получает about:blank
+func TestProblemJSONUnmappedStatus(t *testing.T) {
+	h := NewHTTPHandler(NewMemStore())
+	h.problemJSON = true
+	rec := httptest.NewRecorder()
+	h.responseError(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusTooManyRequests, "slow down")
+
+	if body := decodeBody(t, rec); body["type"] != "about:blank" || body["status"] != float64(http.StatusTooManyRequests) {
+		t.Errorf("problem = %v", body)
+	}
+}
+
+func TestCategoryRules(t *testing.T) {
+	store := testDBStore(t)
+	ctx := context.Background()
+	from := newTestDBWallet(t, store, 100_00)
+	payroll := newTestDBWallet(t, store, 0)
+	other := newTestDBWallet(t, store, 0)
+
+	_, err := store.CreateCategoryRule(ctx, CategoryRule{To: payroll.ID, Category: "payroll"})
+	if err != nil {
+		t.Fatalf("CreateCategoryRule: %v", err)
+	}
+
+	matched, err := store.Transfer(ctx, from.ID, payroll.ID, 10_00, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if matched.Transaction.Category != "payroll" {
+		t.Errorf("matching transfer category = %q, want payroll", matched.Transaction.Category)
+	}
+	unmatched, err := store.Transfer(ctx, from.ID, other.ID, 10_00, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if unmatched.Transaction.Category != "" {
+		t.Errorf("non-matching transfer category = %q, want none", unmatched.Transaction.Category)
+	}
+
+	// Категория сохраняется в журнале
+	history, err := store.GetHistory(ctx, payroll.ID, HistoryFilter{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Category != "payroll" {
+		t.Errorf("history = %+v, want one payroll transaction", history)
+	}
+}
+
+// delayedConnector имитирует базу данных, которая принимает соединения только начиная с readyAt
+type delayedConnector struct {
+	readyAt time.Time
+}
+
+func (c delayedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if time.Now().Before(c.readyAt) {
+		return nil, errors.New("connection refused")
+	}
+	return delayedConn{}, nil
+}
+
+func (c delayedConnector) Driver() driver.Driver {
+	return nil
+}
+
+type delayedConn struct{}
+
+func (delayedConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (delayedConn) Close() error {
+	return nil
+}
+
+func (delayedConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestWaitForDB(t *testing.T) {
+	db := sql.OpenDB(delayedConnector{readyAt: time.Now().Add(250 * time.Millisecond)})
+	defer db.Close()
+
+	started := time.Now()
+	err := waitForDB(db, 5*time.Second)
+	if err != nil {
+		t.Fatalf("waitForDB: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Errorf("waitForDB returned after %s, before the database was ready", elapsed)
+	}
+
+	unavailable := sql.OpenDB(delayedConnector{readyAt: time.Now().Add(time.Hour)})
+	defer unavailable.Close()
+	err = waitForDB(unavailable, 200*time.Millisecond)
+	if err == nil {
+		t.Fatal("waitForDB succeeded, want timeout error")
+	}
+}
+
+func TestHasTransacted(t *testing.T) {
+	store := testDBStore(t)
+	ctx := context.Background()
+	a := newTestDBWallet(t, store, 100_00)
+	b := newTestDBWallet(t, store, 0)
+	c := newTestDBWallet(t, store, 0)
+	_, err := store.Transfer(ctx, a.ID, b.ID, 10_00, TransferOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		walletID, otherID string
+		want              bool
+	}{
+		{walletID: a.ID, otherID: b.ID, want: true},
+		{walletID: b.ID, otherID: a.ID, want: true},
+		{walletID: a.ID, otherID: c.ID, want: false},
+		{walletID: b.ID, otherID: c.ID, want: false},
+	}
+	for _, tt := range tests {
+		got, err := store.HasTransacted(ctx, tt.walletID, tt.otherID)
+		if err != nil {
+			t.Fatalf("HasTransacted: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("HasTransacted(%s, %s) = %v, want %v", tt.walletID, tt.otherID, got, tt.want)
+		}
+	}
+
+	h := NewHTTPHandler(store)
+	rec := httptest.NewRecorder()
+	h.HasTransactedHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+a.ID+"/has-transacted?with="+b.ID, a.ID, ""))
+	if rec.Code != http.StatusOK || decodeBody(t, rec)["has_transacted"] != true {
+		t.Errorf("handler response %d %s, want has_transacted true", rec.Code, rec.Body.String())
+	}
+	missing := uuid.New().String()
+	for _, tt := range []struct {
+		name       string
+		walletID   string
+		query      string
+		wantStatus int
+	}{
+		{name: "without with", walletID: a.ID, wantStatus: http.StatusBadRequest},
+		{name: "with is not a wallet id", walletID: a.ID, query: "?with=not-a-uuid", wantStatus: http.StatusBadRequest},
+		{name: "unknown other wallet", walletID: a.ID, query: "?with=" + missing, wantStatus: http.StatusNotFound},
+		{name: "unknown wallet", walletID: missing, query: "?with=" + a.ID, wantStatus: http.StatusNotFound},
+	} {
+		rec = httptest.NewRecorder()
+		h.HasTransactedHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+tt.walletID+"/has-transacted"+tt.query, tt.walletID, ""))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.wantStatus, rec.Body.String())
+		}
+	}
+}
+
+func TestHasTransactedInvalidWith(t *testing.T) {
+	h := newUnreachableDBHandler(t)
+	walletID := uuid.New().String()
+	for _, with := range []string{"", "not-a-uuid", "1"} {
+		rec := httptest.NewRecorder()
+		h.HasTransactedHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+walletID+"/has-transacted?with="+with, walletID, ""))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("with=%q: status = %d, want %d", with, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	store := testDBStore(t)
+	a := newTestDBWallet(t, store, 0)
+	b := newTestDBWallet(t, store, 0)
+	idle := newTestDBWallet(t, store, 0)
+	day := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	insertTestTransaction(t, store, a.ID, b.ID, 10_00, day)
+	latestA := insertTestTransaction(t, store, b.ID, a.ID, 5_00, day.Add(time.Hour))
+	latestB := insertTestTransaction(t, store, b.ID, uuid.New().String(), 1_00, day.Add(2*time.Hour))
+
+	activity, err := store.LastActivity(context.Background(), []string{a.ID, b.ID, idle.ID})
+	if err != nil {
+		t.Fatalf("LastActivity: %v", err)
+	}
+	if len(activity) != 2 {
+		t.Fatalf("activity = %+v, want entries for two wallets", activity)
+	}
+	if activity[a.ID].ID != latestA || activity[b.ID].ID != latestB {
+		t.Errorf("latest transactions %d and %d, want %d and %d", activity[a.ID].ID, activity[b.ID].ID, latestA, latestB)
+	}
+	if _, ok := activity[idle.ID]; ok {
+		t.Error("wallet without transactions is present")
+	}
+}
+
+func TestMaxTransfer(t *testing.T) {
+	store := NewMemStore()
+	store.maxTransfer = 50_00
+	from := newTestWallet(t, store, 200_00)
+	to := newTestWallet(t, store, 0)
+	ctx := context.Background()
+
+	_, err := store.Transfer(ctx, from.ID, to.ID, 50_00, TransferOptions{})
+	if err != nil {
+		t.Errorf("transfer at the maximum: %v", err)
+	}
+	_, err = store.Transfer(ctx, from.ID, to.ID, 50_01, TransferOptions{})
+	if !errors.Is(err, ErrAmountTooLarge) {
+		t.Errorf("transfer above the maximum: error = %v, want ErrAmountTooLarge", err)
+	}
+
+	h := NewHTTPHandler(store)
+	rec := httptest.NewRecorder()
+	h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"50.01"}`))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+
+	// Без ограничения крупный перевод проходит
+	store.maxTransfer = 0
+	_, err = store.Transfer(ctx, from.ID, to.ID, 100_00, TransferOptions{})
+	if err != nil {
+		t.Errorf("transfer without a maximum: %v", err)
+	}
+}
+
+func TestAuditTransfers(t *testing.T) {
+	store := testDBStore(t)
+	from := newTestDBWallet(t, store, 100_00)
+	to := newTestDBWallet(t, store, 0)
+	router := NewHTTPHandler(store).routes()
+
+	tests := []struct {
+		amount     string
+		wantStatus int
+	}{
+		{amount: "10.00", wantStatus: http.StatusOK},
+		{amount: "1000.00", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", strings.NewReader(`{"to":"`+to.ID+`","amount":"`+tt.amount+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		if rec.Code != tt.wantStatus {
+			t.Fatalf("amount %s: status = %d, want %d: %s", tt.amount, rec.Code, tt.wantStatus, rec.Body.String())
+		}
+
+		entry := lastAuditEntry(t, store, from.ID)
+		if entry.Status != tt.wantStatus || entry.Method != http.MethodPost || entry.Path != "/api/v1/wallet/"+from.ID+"/send" ||
+			!strings.HasPrefix(entry.Caller, "anonymous@") {
+			t.Errorf("amount %s: audit entry = %+v, want the transfer with status %d", tt.amount, entry, tt.wantStatus)
+		}
+	}
+
+	entries, err := store.ListAudit(context.Background(), from.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d audit entries, want 2", len(entries))
+	}
+}
+
+func TestBalanceDistribution(t *testing.T) {
+	store := testIsolatedDBStore(t)
+	for _, balance := range []Amount{0, 5_00, 9_99, 10_00, 55_00, 100_00} {
+		newTestDBWallet(t, store, balance)
+	}
+
+	distribution, err := store.BalanceDistribution(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("BalanceDistribution: %v", err)
+	}
+	if len(distribution) != 10 {
+		t.Fatalf("got %d buckets, want 10", len(distribution))
+	}
+	// Интервалы по 10.00 от 0 до 100, максимальный баланс относится к последнему
+	want := map[int]int64{0: 3, 1: 1, 5: 1, 9: 1}
+	for i, bucket := range distribution {
+		if bucket.Count != want[i] {
+			t.Errorf("bucket %d [%v, %v) count = %d, want %d", i, bucket.From, bucket.To, bucket.Count, want[i])
+		}
+	}
+	if distribution[0].From != 0 || distribution[9].To != 100 {
+		t.Errorf("range [%v, %v), want [0, 100)", distribution[0].From, distribution[9].To)
+	}
+}
+
+func TestBalanceDistributionEqualBalances(t *testing.T) {
+	store := testIsolatedDBStore(t)
+	newTestDBWallet(t, store, 20_00)
+	newTestDBWallet(t, store, 20_00)
+
+	distribution, err := store.BalanceDistribution(context.Background(), 4)
+	if err != nil {
+		t.Fatalf("BalanceDistribution: %v", err)
+	}
+	if len(distribution) != 4 || distribution[0].Count != 2 {
+		t.Errorf("distribution = %+v, want both wallets in the first bucket", distribution)
+	}
+}
+
+func TestCacheControlHeaders(t *testing.T) {
+	store := NewMemStore()
+	wallet := newTestWallet(t, store, 0)
+	h := NewHTTPHandler(store)
+	h.balanceCacheControl = "private, max-age=30"
+	h.historyCacheControl = "no-store"
+	router := h.routes()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/api/v1/wallet/" + wallet.ID, want: "private, max-age=30"},
+		{path: "/api/v1/wallet/" + wallet.ID + "/history", want: "no-store"},
+		{path: "/api/v1/version", want: ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", tt.path, rec.Code)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: Cache-Control = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	// Пустое значение отключает заголовок
+	h = NewHTTPHandler(store)
+	h.balanceCacheControl = ""
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/wallet/"+wallet.ID, nil))
+	if got := rec.Header().Get("Cache-Control"); got != "" {
+		t.Errorf("Cache-Control = %q, want none", got)
+	}
+}
+
+// Все пакетные эндпоинты отклоняют запросы больше maxBatchSize одной и той же ошибкой.
+// Проверка выполняется до обращения к базе данных.
+func TestMaxBatchSize(t *testing.T) {
+	h := newUnreachableDBHandler(t)
+	h.maxBatchSize = 2
+	walletID := uuid.New().String()
+
+	items := func(n int, item string) string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = item
+		}
+		return strings.Join(list, ",")
+	}
+	transfer := `{"to":"` + uuid.New().String() + `","amount":"1.00"}`
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{name: "send-batch", handler: h.TransferBatchHandler, body: `{"transfers":[` + items(3, transfer) + `]}`},
+		{name: "last-activity", handler: h.LastActivityHandler, body: `{"wallet_ids":[` + items(3, `"`+walletID+`"`) + `]}`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, walletRequest(http.MethodPost, "/", walletID, tt.body))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		if got := decodeBody(t, rec)["error"]; got != "batch too large: at most 2 items allowed" {
+			t.Errorf("%s: error = %v", tt.name, got)
+		}
+	}
+}
+
+func TestTransferCreatesRecipient(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	h := NewHTTPHandler(store)
+	ctx := context.Background()
+
+	// Без флага отсутствующий получатель отклоняется
+	missing := uuid.New().String()
+	_, err := store.Transfer(ctx, from.ID, missing, 10_00, TransferOptions{})
+	if !errors.Is(err, ErrRecipientNotFound) {
+		t.Fatalf("error = %v, want ErrRecipientNotFound", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send?create_recipient=true", from.ID, `{"to":"`+missing+`","amount":"10.00"}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	recipient, err := store.GetWallet(ctx, missing)
+	if err != nil {
+		t.Fatalf("recipient was not created: %v", err)
+	}
+	if recipient.Balance != 10_00 || recipient.Currency != from.Currency {
+		t.Errorf("recipient = %+v, want 10.00 %s", recipient, from.Currency)
+	}
+}
+
+// Одновременные переводы на один отсутствующий кошелек создают его один раз и зачисляют все суммы
+func TestTransferCreatesRecipientConcurrentlyDB(t *testing.T) {
+	store := testDBStore(t)
+	ctx := context.Background()
+	recipientID := uuid.New().String()
+
+	const senders = 5
+	errs := make(chan error, senders)
+	for i := 0; i < senders; i++ {
+		from := newTestDBWallet(t, store, 10_00)
+		go func() {
+			_, err := store.Transfer(ctx, from.ID, recipientID, 10_00, TransferOptions{CreateRecipient: true})
+			errs <- err
+		}()
+	}
+	for i := 0; i < senders; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Transfer: %v", err)
+		}
+	}
+
+	recipient, err := store.GetWallet(ctx, recipientID)
+	if err != nil {
+		t.Fatalf("GetWallet: %v", err)
+	}
+	if recipient.Balance != senders*10_00 {
+		t.Errorf("recipient balance = %s, want %s", recipient.Balance, Amount(senders*10_00))
+	}
+}
+
+func TestTransferBalancesBeforeAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		fees       FeePolicy
+		wantBefore string
+		wantAfter  string
+	}{
+		{name: "no fee", wantBefore: "50.00", wantAfter: "30.00"},
+		{name: "percent fee", fees: FeePolicy{Percent: 5}, wantBefore: "50.00", wantAfter: "29.00"},
+		{name: "flat and percent fee", fees: FeePolicy{Flat: 50, Percent: 5}, wantBefore: "50.00", wantAfter: "28.50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemStore()
+			store.fees = tt.fees
+			from := newTestWallet(t, store, 50_00)
+			to := newTestWallet(t, store, 0)
+			h := NewHTTPHandler(store)
+
+			rec := httptest.NewRecorder()
+			h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"20.00"}`))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+			var body map[string]json.RawMessage
+			err := json.Unmarshal(rec.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body["balance_before"]) != tt.wantBefore || string(body["balance_after"]) != tt.wantAfter {
+				t.Errorf("balance %s -> %s, want %s -> %s", body["balance_before"], body["balance_after"], tt.wantBefore, tt.wantAfter)
+			}
+
+			wallet, err := store.GetWallet(context.Background(), from.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wallet.Balance.String() != tt.wantAfter {
+				t.Errorf("stored balance = %s, want %s", wallet.Balance, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestDormantWallets(t *testing.T) {
+	store := testIsolatedDBStore(t)
+	since := time.Now().Add(-24 * time.Hour)
+	sender := newTestDBWallet(t, store, 0)
+	receiver := newTestDBWallet(t, store, 0)
+	dormant := newTestDBWallet(t, store, 0)
+	unused := newTestDBWallet(t, store, 0)
+	insertTestTransaction(t, store, sender.ID, receiver.ID, 1_00, since.Add(time.Hour))
+	insertTestTransaction(t, store, dormant.ID, sender.ID, 1_00, since.Add(-time.Hour))
+
+	// Входящая транзакция после since тоже делает кошелек активным
+	wallets, err := store.DormantWallets(context.Background(), since)
+	if err != nil {
+		t.Fatalf("DormantWallets: %v", err)
+	}
+	got := map[string]bool{}
+	for _, wallet := range wallets {
+		got[wallet.ID] = true
+	}
+	if len(got) != 2 || !got[dormant.ID] || !got[unused.ID] {
+		t.Errorf("dormant wallets = %v, want %s and %s", got, dormant.ID, unused.ID)
+	}
+
+	wallets, err = store.DormantWallets(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("DormantWallets: %v", err)
+	}
+	if len(wallets) != 4 {
+		t.Errorf("got %d dormant wallets since now, want 4", len(wallets))
+	}
+}
+
+func TestDormantWalletsInvalidSince(t *testing.T) {
+	h := newUnreachableDBHandler(t)
+	for _, since := range []string{"", "yesterday", "2024-03-01"} {
+		rec := httptest.NewRecorder()
+		h.DormantWalletsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/admin/wallets/dormant?since="+since, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("since=%q: status = %d, want %d", since, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHistoryTimeZone(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 10_00)
+	to := newTestWallet(t, store, 0)
+	_, err := store.Transfer(context.Background(), from.ID, to.ID, 1_00, TransferOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPHandler(store)
+
+	historyTime := func(query string) (time.Time, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID+"/history"+query, from.ID, ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", query, rec.Code, rec.Body.String())
+		}
+		var history []struct {
+			Time string `json:"time"`
+		}
+		err := json.Unmarshal(rec.Body.Bytes(), &history)
+		if err != nil || len(history) != 1 {
+			t.Fatalf("%s: unexpected history %s", query, rec.Body.String())
+		}
+		at, err := time.Parse(time.RFC3339Nano, history[0].Time)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return at, history[0].Time
+	}
+
+	utc, raw := historyTime("")
+	if _, offset := utc.Zone(); offset != 0 {
+		t.Errorf("default time %s is not in UTC", raw)
+	}
+	for _, zone := range []string{"Asia/Tokyo", "America/New_York"} {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			t.Skipf("time zone database unavailable: %v", err)
+		}
+		at, raw := historyTime("?tz=" + zone)
+		_, offset := at.Zone()
+		_, wantOffset := utc.In(loc).Zone()
+		if !at.Equal(utc) || offset != wantOffset {
+			t.Errorf("tz=%s: time %s, want %s", zone, raw, utc.In(loc).Format(time.RFC3339Nano))
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID+"/history?tz=Mars/Olympus", from.ID, ""))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid tz: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLargeTransactions(t *testing.T) {
+	store := testIsolatedDBStore(t)
+	from := newTestDBWallet(t, store, 0)
+	to := newTestDBWallet(t, store, 0)
+	day := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	older := insertTestTransaction(t, store, from.ID, to.ID, 150_00, day)
+	insertTestTransaction(t, store, from.ID, to.ID, 99_99, day.Add(time.Hour))
+	insertTestTransaction(t, store, from.ID, to.ID, 100_00, day.Add(2*time.Hour))
+	newer := insertTestTransaction(t, store, from.ID, to.ID, 500_00, day.Add(3*time.Hour))
+
+	// Сумма, равная порогу, крупной не считается
+	transactions, err := store.LargeTransactions(context.Background(), 100_00, 10, 0)
+	if err != nil {
+		t.Fatalf("LargeTransactions: %v", err)
+	}
+	if len(transactions) != 2 || transactions[0].ID != newer || transactions[1].ID != older {
+		t.Fatalf("large transactions = %+v, want %d and %d newest first", transactions, newer, older)
+	}
+
+	transactions, err = store.LargeTransactions(context.Background(), 100_00, 1, 1)
+	if err != nil {
+		t.Fatalf("LargeTransactions: %v", err)
+	}
+	if len(transactions) != 1 || transactions[0].ID != older {
+		t.Errorf("second page = %+v, want only %d", transactions, older)
+	}
+}
+
+func TestVelocity(t *testing.T) {
+	store := testDBStore(t)
+	wallet := newTestDBWallet(t, store, 0)
+	other := newTestDBWallet(t, store, 0)
+	unrelated := newTestDBWallet(t, store, 0)
+	now := time.Now()
+	insertTestTransaction(t, store, wallet.ID, other.ID, 10_00, now.Add(-10*time.Minute))
+	insertTestTransaction(t, store, other.ID, wallet.ID, 5_50, now.Add(-30*time.Minute))
+	insertTestTransaction(t, store, wallet.ID, other.ID, 100_00, now.Add(-2*time.Hour))
+	insertTestTransaction(t, store, other.ID, unrelated.ID, 7_00, now.Add(-5*time.Minute))
+
+	tests := []struct {
+		window    time.Duration
+		wantCount int64
+		wantTotal Amount
+	}{
+		{window: time.Minute, wantCount: 0, wantTotal: 0},
+		{window: 20 * time.Minute, wantCount: 1, wantTotal: 10_00},
+		{window: time.Hour, wantCount: 2, wantTotal: 15_50},
+		{window: 3 * time.Hour, wantCount: 3, wantTotal: 115_50},
+	}
+	for _, tt := range tests {
+		velocity, err := store.Velocity(context.Background(), wallet.ID, tt.window)
+		if err != nil {
+			t.Fatalf("Velocity(%s): %v", tt.window, err)
+		}
+		if velocity.Count != tt.wantCount || velocity.Total != tt.wantTotal {
+			t.Errorf("Velocity(%s) = %d, %s, want %d, %s", tt.window, velocity.Count, velocity.Total, tt.wantCount, tt.wantTotal)
+		}
+	}
+}
+
+func TestVelocityInvalidWindow(t *testing.T) {
+	h := newUnreachableDBHandler(t)
+	walletID := uuid.New().String()
+	for _, window := range []string{"abc", "0s", "-1h"} {
+		rec := httptest.NewRecorder()
+		h.VelocityHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+walletID+"/velocity?window="+window, walletID, ""))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("window=%s: status = %d, want %d", window, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHistoryPartialContent(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 10_00)
+	to := newTestWallet(t, store, 0)
+	for i := 0; i < 3; i++ {
+		_, err := store.Transfer(context.Background(), from.ID, to.ID, 1_00, TransferOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHTTPHandler(store)
+
+	tests := []struct {
+		query     string
+		wantCode  int
+		wantRange string
+		wantRows  int
+	}{
+		{query: "?limit=2", wantCode: http.StatusPartialContent, wantRange: "transactions 0-1/*", wantRows: 2},
+		{query: "?limit=1&offset=1", wantCode: http.StatusPartialContent, wantRange: "transactions 1-1/*", wantRows: 1},
+		{query: "?limit=3", wantCode: http.StatusOK, wantRows: 3},
+		{query: "?limit=2&offset=1", wantCode: http.StatusOK, wantRows: 2},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID+"/history"+tt.query, from.ID, ""))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.query, rec.Code, tt.wantCode)
+		}
+		if got := rec.Header().Get("Content-Range"); got != tt.wantRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tt.query, got, tt.wantRange)
+		}
+		var history []Transaction
+		err := json.Unmarshal(rec.Body.Bytes(), &history)
+		if err != nil || len(history) != tt.wantRows {
+			t.Errorf("%s: got %d rows (%v), want %d", tt.query, len(history), err, tt.wantRows)
+		}
+	}
+}
+
+func TestDuplicateTransferWindow(t *testing.T) {
+	send := func(t *testing.T, h *HTTPHandler, fromID, toID, amount string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+fromID+"/send", fromID, `{"to":"`+toID+`","amount":"`+amount+`"}`))
+		return rec
+	}
+
+	t.Run("warn", func(t *testing.T) {
+		store := NewMemStore()
+		store.duplicateWindow = time.Minute
+		from := newTestWallet(t, store, 100_00)
+		to := newTestWallet(t, store, 0)
+		h := NewHTTPHandler(store)
+
+		for i, tt := range []struct {
+			amount      string
+			wantWarning any
+		}{
+			{amount: "10.00", wantWarning: nil},
+			{amount: "10.00", wantWarning: true},
+			{amount: "10.01", wantWarning: nil},
+		} {
+			rec := send(t, h, from.ID, to.ID, tt.amount)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("transfer %d: status = %d: %s", i, rec.Code, rec.Body.String())
+			}
+			if got := decodeBody(t, rec)["duplicate_warning"]; got != tt.wantWarning {
+				t.Errorf("transfer %d: duplicate_warning = %v, want %v", i, got, tt.wantWarning)
+			}
+		}
+		if wallet, _ := store.GetWallet(context.Background(), to.ID); wallet.Balance != 30_01 {
+			t.Errorf("recipient balance = %s, want 30.01", wallet.Balance)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		store := NewMemStore()
+		store.duplicateWindow = time.Minute
+		store.rejectDuplicates = true
+		from := newTestWallet(t, store, 100_00)
+		to := newTestWallet(t, store, 0)
+		h := NewHTTPHandler(store)
+
+		if rec := send(t, h, from.ID, to.ID, "10.00"); rec.Code != http.StatusOK {
+			t.Fatalf("first transfer: status = %d: %s", rec.Code, rec.Body.String())
+		}
+		rec := send(t, h, from.ID, to.ID, "10.00")
+		if rec.Code != http.StatusConflict || decodeBody(t, rec)["error"] != ErrDuplicateTransfer.Error() {
+			t.Errorf("duplicate: status = %d: %s, want %d", rec.Code, rec.Body.String(), http.StatusConflict)
+		}
+		if wallet, _ := store.GetWallet(context.Background(), to.ID); wallet.Balance != 10_00 {
+			t.Errorf("recipient balance = %s, want 10.00", wallet.Balance)
+		}
+	})
+
+	t.Run("outside window", func(t *testing.T) {
+		store := NewMemStore()
+		store.duplicateWindow = time.Millisecond
+		store.rejectDuplicates = true
+		from := newTestWallet(t, store, 100_00)
+		to := newTestWallet(t, store, 0)
+		h := NewHTTPHandler(store)
+
+		send(t, h, from.ID, to.ID, "10.00")
+		time.Sleep(5 * time.Millisecond)
+		if rec := send(t, h, from.ID, to.ID, "10.00"); rec.Code != http.StatusOK {
+			t.Errorf("transfer after the window: status = %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+// failingStore завершает переводы заданной ошибкой
+type failingStore struct {
+	*MemStore
+	err error
+}
+
+func (s failingStore) Transfer(ctx context.Context, fromID, toID string, amount Amount, opts TransferOptions) (*TransferResult, error) {
+	return nil, s.err
+}
+
+func TestTransferRetryHint(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+
+	tests := []struct {
+		name          string
+		err           error
+		wantStatus    int
+		wantRetryable bool
+	}{
+		{name: "serialization failure", err: &pq.Error{Code: "40001"}, wantStatus: http.StatusServiceUnavailable, wantRetryable: true},
+		{name: "deadlock", err: fmt.Errorf("transfer: %w", &pq.Error{Code: "40P01"}), wantStatus: http.StatusServiceUnavailable, wantRetryable: true},
+		{name: "connection lost", err: driver.ErrBadConn, wantStatus: http.StatusServiceUnavailable, wantRetryable: true},
+		{name: "insufficient funds", err: ErrInsufficientFunds, wantStatus: http.StatusBadRequest},
+		{name: "constraint violation", err: &pq.Error{Code: "23514"}, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHTTPHandler(failingStore{store, tt.err})
+			rec := httptest.NewRecorder()
+			h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"10.00"}`))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			body := decodeBody(t, rec)
+			retryable, _ := body["retryable"].(bool)
+			retryAfter, _ := body["retry_after_ms"].(float64)
+			if retryable != tt.wantRetryable || (retryAfter > 0) != tt.wantRetryable {
+				t.Errorf("retryable = %v, retry_after_ms = %v, want retryable %v", retryable, retryAfter, tt.wantRetryable)
+			}
+		})
+	}
+}
+
+// repeatedRand отдает одни и те же байты, поэтому uuid.New возвращает одинаковые ID
+type repeatedRand struct{}
+
+func (repeatedRand) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0x42
+	}
+	return len(p), nil
+}
+
+// repeatWalletIDs заставляет все кошельки, созданные в тесте, получать один и тот же ID
+func repeatWalletIDs(t *testing.T) {
+	uuid.SetRand(repeatedRand{})
+	t.Cleanup(func() { uuid.SetRand(nil) })
+}
+
+func TestCreateWalletDuplicate(t *testing.T) {
+	h := NewHTTPHandler(NewMemStore())
+	repeatWalletIDs(t)
+	checkCreateWalletDuplicate(t, h)
+}
+
+func TestCreateWalletDuplicateDB(t *testing.T) {
+	store := testIsolatedDBStore(t)
+	repeatWalletIDs(t)
+	checkCreateWalletDuplicate(t, NewHTTPHandler(store))
+
+	// Нарушение первичного ключа не должно выходить за пределы хранилища как ошибка драйвера
+	_, err := store.CreateWallet(context.Background(), "")
+	if !errors.Is(err, ErrWalletExists) {
+		t.Errorf("duplicate CreateWallet error = %v, want ErrWalletExists", err)
+	}
+}
+
+func checkCreateWalletDuplicate(t *testing.T, h *HTTPHandler) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.CreateWalletHandler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/wallet", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first wallet: status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.CreateWalletHandler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/wallet", nil))
+	if rec.Code != http.StatusConflict || decodeBody(t, rec)["error"] != ErrWalletExists.Error() {
+		t.Errorf("duplicate wallet: status = %d: %s, want %d", rec.Code, rec.Body.String(), http.StatusConflict)
+	}
+}
+
+func TestMonthlyOpeningBalances(t *testing.T) {
+	store := testDBStore(t)
+	// Текущий баланс сходится с историей: 100 + 50 - 20 - 30 + 10
+	wallet := newTestDBWallet(t, store, 110_00)
+	other := newTestDBWallet(t, store, 0)
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	}
+	insertTestTransaction(t, store, other.ID, wallet.ID, 100_00, at(2023, time.December, 15))
+	insertTestTransaction(t, store, other.ID, wallet.ID, 50_00, at(2024, time.February, 1))
+	insertTestTransaction(t, store, wallet.ID, other.ID, 20_00, at(2024, time.February, 29))
+	insertTestTransaction(t, store, wallet.ID, other.ID, 30_00, at(2024, time.June, 10))
+	insertTestTransaction(t, store, other.ID, wallet.ID, 10_00, at(2025, time.January, 5))
+
+	balances, err := store.MonthlyOpeningBalances(context.Background(), wallet.ID, 2024)
+	if err != nil {
+		t.Fatalf("MonthlyOpeningBalances: %v", err)
+	}
+	want := []Amount{100_00, 100_00, 130_00, 130_00, 130_00, 130_00, 100_00, 100_00, 100_00, 100_00, 100_00, 100_00}
+	if len(balances) != len(want) {
+		t.Fatalf("got %d months, want %d", len(balances), len(want))
+	}
+	for i, balance := range balances {
+		month := time.Date(2024, time.Month(i+1), 1, 0, 0, 0, 0, time.UTC).Format("2006-01")
+		if balance.Month != month || balance.Opening != want[i] {
+			t.Errorf("month %d = %+v, want %s opening %s", i+1, balance, month, want[i])
+		}
+	}
+
+	_, err = store.MonthlyOpeningBalances(context.Background(), uuid.New().String(), 2024)
+	if !errors.Is(err, ErrWalletNotFound) {
+		t.Errorf("unknown wallet error = %v, want ErrWalletNotFound", err)
+	}
+}
+
+func TestMonthlyOpeningInvalidYear(t *testing.T) {
+	h := newUnreachableDBHandler(t)
+	walletID := uuid.New().String()
+	for _, year := range []string{"", "abc", "1969", "10000"} {
+		rec := httptest.NewRecorder()
+		h.MonthlyOpeningHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+walletID+"/monthly-opening?year="+year, walletID, ""))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("year=%q: status = %d, want %d", year, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTransactionsImmutable(t *testing.T) {
+	store := testDBStore(t)
+	from := newTestDBWallet(t, store, 0)
+	to := newTestDBWallet(t, store, 0)
+	id := insertTestTransaction(t, store, from.ID, to.ID, 10_00, time.Now())
+
+	for _, query := range []string{
+		"UPDATE transactions SET amount = 1 WHERE id = $1",
+		"DELETE FROM transactions WHERE id = $1",
+	} {
+		_, err := store.db.Exec(query, id)
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code != "42501" {
+			t.Errorf("%s: error = %v, want insufficient_privilege", query, err)
+		}
+	}
+
+	var amount Amount
+	err := store.db.QueryRow("SELECT amount FROM transactions WHERE id = $1", id).Scan(&amount)
+	if err != nil || amount != 10_00 {
+		t.Fatalf("transaction amount = %s, %v, want unchanged 10.00", amount, err)
+	}
+
+	// Санкционированные операции явно разрешают изменение внутри своей транзакции
+	tx, err := store.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("SET LOCAL ewallet.allow_transaction_changes = 'on'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("DELETE FROM transactions WHERE id = $1", id)
+	if err != nil {
+		t.Errorf("sanctioned DELETE: %v", err)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	store := testDBStore(t)
+	store.fees = FeePolicy{Flat: 1_00}
+	store.splitFees = true
+	wallet := newTestDBWallet(t, store, 100_00)
+	first := newTestDBWallet(t, store, 0)
+	second := newTestDBWallet(t, store, 0)
+	sender := newTestDBWallet(t, store, 0)
+	now := time.Now()
+	insertTestTransaction(t, store, wallet.ID, first.ID, 10_00, now)
+	insertTestTransaction(t, store, wallet.ID, first.ID, 5_00, now)
+	insertTestTransaction(t, store, wallet.ID, second.ID, 30_00, now)
+	insertTestTransaction(t, store, sender.ID, wallet.ID, 50_00, now)
+	// Отдельная запись комиссии не считается переводом получателю
+	_, err := store.Transfer(context.Background(), wallet.ID, second.ID, 10_00, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+
+	recipients, err := store.Recipients(context.Background(), wallet.ID)
+	if err != nil {
+		t.Fatalf("Recipients: %v", err)
+	}
+	want := []Recipient{
+		{WalletID: second.ID, Count: 2, Total: 40_00},
+		{WalletID: first.ID, Count: 2, Total: 15_00},
+	}
+	if len(recipients) != len(want) {
+		t.Fatalf("recipients = %+v, want %+v", recipients, want)
+	}
+	for i := range want {
+		if recipients[i] != want[i] {
+			t.Errorf("recipient %d = %+v, want %+v", i, recipients[i], want[i])
+		}
+	}
+
+	recipients, err = store.Recipients(context.Background(), sender.ID)
+	if err != nil || len(recipients) != 1 || recipients[0].WalletID != wallet.ID {
+		t.Errorf("sender recipients = %+v, %v, want only %s", recipients, err, wallet.ID)
+	}
+
+	_, err = store.Recipients(context.Background(), uuid.New().String())
+	if !errors.Is(err, ErrWalletNotFound) {
+		t.Errorf("unknown wallet error = %v, want ErrWalletNotFound", err)
+	}
+
+	missing := uuid.New().String()
+	rec := httptest.NewRecorder()
+	NewHTTPHandler(store).RecipientsHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+missing+"/recipients", missing, ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown wallet: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	defer func(limit int64) { maxResponseBytes = limit }(maxResponseBytes)
+
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+	for i := 0; i < 20; i++ {
+		_, err := store.Transfer(context.Background(), from.ID, to.ID, 1_00, TransferOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHTTPHandler(store)
+	history := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+from.ID+"/history"+query, from.ID, ""))
+		return rec
+	}
+
+	maxResponseBytes = 0
+	full := history("?limit=10")
+	if full.Code != http.StatusPartialContent {
+		t.Fatalf("without limit: status = %d: %s", full.Code, full.Body.String())
+	}
+
+	// Лимит меньше полной страницы, но больше одной транзакции
+	maxResponseBytes = int64(full.Body.Len() / 2)
+	rec := history("?limit=10")
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(decodeBody(t, rec)["error"].(string), "response too large") {
+		t.Fatalf("above limit: status = %d: %s, want %d", rec.Code, rec.Body.String(), http.StatusInternalServerError)
+	}
+	if rec.Header().Get("Content-Range") != "" {
+		t.Errorf("rejected response has Content-Range %q", rec.Header().Get("Content-Range"))
+	}
+
+	rec = history("?limit=2")
+	if rec.Code != http.StatusPartialContent || rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("below limit: status = %d, Content-Length %q for %d bytes", rec.Code, rec.Header().Get("Content-Length"), rec.Body.Len())
+	}
+}
+
+func TestValidReceiptRef(t *testing.T) {
+	tests := map[string]bool{
+		"https://files.example.com/receipts/42.pdf": true,
+		"http://example.com/r?id=1":                 true,
+		"receipts/2024/03/42.pdf":                   true,
+		"https://":                                  false,
+		"ftp://example.com/42.pdf":                  false,
+		"receipts/42 copy.pdf":                      false,
+		"../<script>":                               false,
+		strings.Repeat("a", 1025):                   false,
+	}
+	for ref, want := range tests {
+		if got := validReceiptRef(ref); got != want {
+			t.Errorf("validReceiptRef(%.40q) = %v, want %v", ref, got, want)
+		}
+	}
+}
+
+func TestTransferReceiptRef(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+	h := NewHTTPHandler(store)
+
+	rec := httptest.NewRecorder()
+	h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"10.00","receipt_ref":"ftp://example.com/42.pdf"}`))
+	if rec.Code != http.StatusBadRequest || decodeBody(t, rec)["error"] != ErrInvalidReceiptRef.Error() {
+		t.Errorf("invalid receipt_ref: status = %d: %s, want %d", rec.Code, rec.Body.String(), http.StatusBadRequest)
+	}
+
+	rec = httptest.NewRecorder()
+	h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"10.00","receipt_ref":"receipts/42.pdf"}`))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+to.ID+"/history", to.ID, ""))
+	var history []Transaction
+	err := json.Unmarshal(rec.Body.Bytes(), &history)
+	if err != nil || len(history) != 1 || history[0].ReceiptRef != "receipts/42.pdf" {
+		t.Errorf("history = %s, want one transaction with the receipt reference", rec.Body.String())
+	}
+}
+
+func TestTransferReceiptRefDB(t *testing.T) {
+	store := testDBStore(t)
+	from := newTestDBWallet(t, store, 100_00)
+	to := newTestDBWallet(t, store, 0)
+	ref := "https://files.example.com/receipts/" + uuid.New().String() + ".pdf"
+
+	_, err := store.Transfer(context.Background(), from.ID, to.ID, 10_00, TransferOptions{ReceiptRef: ref})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	history, err := store.GetHistory(context.Background(), to.ID, HistoryFilter{}, 10, 0)
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(history) != 1 || history[0].ReceiptRef != ref {
+		t.Errorf("history = %+v, want receipt_ref %s", history, ref)
+	}
+}
+
+// slowTransferStore проводит переводы с задержкой, чтобы время обработки было заметным
+type slowTransferStore struct {
+	*MemStore
+	delay time.Duration
+}
+
+func (s slowTransferStore) Transfer(ctx context.Context, fromID, toID string, amount Amount, opts TransferOptions) (*TransferResult, error) {
+	time.Sleep(s.delay)
+	return s.MemStore.Transfer(ctx, fromID, toID, amount, opts)
+}
+
+func TestTransferProcessingTime(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 100_00)
+	to := newTestWallet(t, store, 0)
+
+	tests := []struct {
+		name    string
+		store   Store
+		atLeast float64
+	}{
+		{name: "instant", store: store, atLeast: 0},
+		{name: "slow", store: slowTransferStore{store, 20 * time.Millisecond}, atLeast: 20},
+	}
+	for _, tt := range tests {
+		h := NewHTTPHandler(tt.store)
+		rec := httptest.NewRecorder()
+		h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"1.00"}`))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", tt.name, rec.Code, rec.Body.String())
+		}
+		elapsed, ok := decodeBody(t, rec)["processing_time_ms"].(float64)
+		if !ok || elapsed < tt.atLeast {
+			t.Errorf("%s: processing_time_ms = %v, want a number of at least %v", tt.name, elapsed, tt.atLeast)
+		}
+	}
+}
+
+func TestZeroAmountTransfers(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		store := NewMemStore()
+		store.acceptZeroTransfers = accept
+		store.fees = FeePolicy{Flat: 1_00}
+		from := newTestWallet(t, store, 10_00)
+		to := newTestWallet(t, store, 0)
+		h := NewHTTPHandler(store)
+
+		rec := httptest.NewRecorder()
+		h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"0"}`))
+		if !accept {
+			if rec.Code != http.StatusBadRequest || decodeBody(t, rec)["error"] != ErrInvalidAmount.Error() {
+				t.Errorf("rejecting: status = %d: %s, want %d", rec.Code, rec.Body.String(), http.StatusBadRequest)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("accepting: status = %d: %s", rec.Code, rec.Body.String())
+		}
+		checkZeroAmountTransfer(t, store, from.ID, to.ID, 10_00)
+	}
+}
+
+func TestZeroAmountTransfersDB(t *testing.T) {
+	store := testDBStore(t)
+	store.acceptZeroTransfers = true
+	store.fees = FeePolicy{Flat: 1_00}
+	from := newTestDBWallet(t, store, 10_00)
+	to := newTestDBWallet(t, store, 0)
+	_, err := store.Transfer(context.Background(), from.ID, to.ID, 0, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	checkZeroAmountTransfer(t, store, from.ID, to.ID, 10_00)
+}
+
+// checkZeroAmountTransfer проверяет, что перевод на нулевую сумму записан в историю без комиссии
+// и не изменил балансы
+func checkZeroAmountTransfer(t *testing.T, store Store, fromID, toID string, fromBalance Amount) {
+	t.Helper()
+	ctx := context.Background()
+	for id, want := range map[string]Amount{fromID: fromBalance, toID: 0} {
+		wallet, err := store.GetWallet(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wallet.Balance != want {
+			t.Errorf("wallet %s balance = %s, want %s", id, wallet.Balance, want)
+		}
+	}
+	history, err := store.GetHistory(ctx, toID, HistoryFilter{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Amount != 0 || history[0].Fee != 0 {
+		t.Errorf("history = %+v, want one zero-amount transaction without fee", history)
+	}
+}
+
+func TestCounterpartyCounts(t *testing.T) {
+	store := testDBStore(t)
+	wallet := newTestDBWallet(t, store, 0)
+	frequent := newTestDBWallet(t, store, 0)
+	rare := newTestDBWallet(t, store, 0)
+	unrelated := newTestDBWallet(t, store, 0)
+	now := time.Now()
+	insertTestTransaction(t, store, wallet.ID, frequent.ID, 1_00, now)
+	insertTestTransaction(t, store, wallet.ID, frequent.ID, 2_00, now)
+	insertTestTransaction(t, store, frequent.ID, wallet.ID, 3_00, now)
+	insertTestTransaction(t, store, rare.ID, wallet.ID, 4_00, now)
+	insertTestTransaction(t, store, frequent.ID, unrelated.ID, 5_00, now)
+
+	counts, err := store.CounterpartyCounts(context.Background(), wallet.ID)
+	if err != nil {
+		t.Fatalf("CounterpartyCounts: %v", err)
+	}
+	want := []CounterpartyCount{
+		{WalletID: frequent.ID, Sent: 2, Received: 1, Total: 3},
+		{WalletID: rare.ID, Sent: 0, Received: 1, Total: 1},
+	}
+	if len(counts) != len(want) {
+		t.Fatalf("counts = %+v, want %+v", counts, want)
+	}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Errorf("counterparty %d = %+v, want %+v", i, counts[i], want[i])
+		}
+	}
+
+	_, err = store.CounterpartyCounts(context.Background(), uuid.New().String())
+	if !errors.Is(err, ErrWalletNotFound) {
+		t.Errorf("unknown wallet error = %v, want ErrWalletNotFound", err)
+	}
+}
+
+// Каждый из этих запросов проходит в нестрогом режиме и отклоняется в строгом
+func TestDecodeJSONStrictRejectsLenientInput(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		wantStatus  int
+	}{
+		{name: "unknown field", body: `{"to":"a","amount":"1.00","memo":"x"}`, contentType: "application/json", wantStatus: http.StatusBadRequest},
+		{name: "missing required field", body: `{"to":"a"}`, contentType: "application/json", wantStatus: http.StatusBadRequest},
+		{name: "trailing data", body: `{"to":"a","amount":"1.00"} {}`, contentType: "application/json", wantStatus: http.StatusBadRequest},
+		{name: "body too large", body: `{"to":"` + strings.Repeat("a", 100) + `","amount":"1.00"}`, contentType: "application/json", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "no content type", body: `{"to":"a","amount":"1.00"}`, wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				h := NewHTTPHandler(NewMemStore())
+				h.strictJSON = strict
+				h.maxRequestBytes = 64
+
+				r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+				if tt.contentType != "" {
+					r.Header.Set("Content-Type", tt.contentType)
+				}
+				rec := httptest.NewRecorder()
+				var request struct {
+					To     string `json:"to"`
+					Amount Amount `json:"amount"`
+				}
+				ok := h.decodeJSON(rec, r, &request, "to", "amount")
+				if !strict && !ok {
+					t.Errorf("lenient decodeJSON rejected the body: %d %s", rec.Code, rec.Body.String())
+				}
+				if strict && (ok || rec.Code != tt.wantStatus) {
+					t.Errorf("strict decodeJSON: ok = %v, status = %d, want rejection with %d", ok, rec.Code, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestMemStoreHandlers(t *testing.T) {
+	store := NewMemStore()
+	store.initialBalance = 100_00
+	h := NewHTTPHandler(store)
+
+	create := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.CreateWalletHandler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/wallet", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("create: status = %d: %s", rec.Code, rec.Body.String())
+		}
+		return decodeBody(t, rec)["id"].(string)
+	}
+	balance := func(id string) any {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.GetWalletHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+id, id, ""))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("get %s: status = %d: %s", id, rec.Code, rec.Body.String())
+		}
+		return decodeBody(t, rec)["balance"]
+	}
+	send := func(from, to, amount string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from+"/send", from, `{"to":"`+to+`","amount":"`+amount+`"}`))
+		return rec
+	}
+
+	from, to := create(), create()
+	if rec := send(from, to, "40.00"); rec.Code != http.StatusOK {
+		t.Fatalf("transfer: status = %d: %s", rec.Code, rec.Body.String())
+	}
+	// Перевод без достаточных средств не меняет ни один из балансов
+	if rec := send(from, to, "60.01"); rec.Code != http.StatusBadRequest || decodeBody(t, rec)["error"] != ErrInsufficientFunds.Error() {
+		t.Errorf("overdraft: status = %d: %s, want %d", rec.Code, rec.Body.String(), http.StatusBadRequest)
+	}
+	if got := balance(from); got != 60.0 {
+		t.Errorf("sender balance = %v, want 60.00", got)
+	}
+	if got := balance(to); got != 140.0 {
+		t.Errorf("recipient balance = %v, want 140.00", got)
+	}
+
+	rec := httptest.NewRecorder()
+	h.GetHistoryHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+to+"/history", to, ""))
+	var history []Transaction
+	err := json.Unmarshal(rec.Body.Bytes(), &history)
+	if err != nil || len(history) != 1 || history[0].From != from || history[0].Amount != 40_00 {
+		t.Errorf("history = %s, want one transfer of 40.00 from %s", rec.Body.String(), from)
+	}
+
+	missing := uuid.New().String()
+	rec = httptest.NewRecorder()
+	h.GetWalletHandler(rec, walletRequest(http.MethodGet, "/api/v1/wallet/"+missing, missing, ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown wallet: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// Параллельные переводы в MemStore не уводят баланс в минус и сохраняют общую сумму
+func TestMemStoreConcurrentTransfers(t *testing.T) {
+	store := NewMemStore()
+	from := newTestWallet(t, store, 10_00)
+	to := newTestWallet(t, store, 0)
+
+	const transfers = 50
+	var succeeded atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < transfers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Transfer(context.Background(), from.ID, to.ID, 1_00, TransferOptions{})
+			switch {
+			case err == nil:
+				succeeded.Add(1)
+			case !errors.Is(err, ErrInsufficientFunds):
+				t.Errorf("Transfer: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sender, _ := store.GetWallet(context.Background(), from.ID)
+	recipient, _ := store.GetWallet(context.Background(), to.ID)
+	if succeeded.Load() != 10 || sender.Balance != 0 || recipient.Balance != 10_00 {
+		t.Errorf("%d transfers succeeded, balances %s and %s, want 10, 0.00 and 10.00", succeeded.Load(), sender.Balance, recipient.Balance)
+	}
+}
+
+// Встречные переводы A→B и B→A блокируют кошельки в одном порядке и не взаимоблокируются
+func TestConcurrentBidirectionalTransfers(t *testing.T) {
+	store := testDBStore(t)
+	// Без повторов взаимоблокировка не будет скрыта повторным выполнением транзакции
+	store.txAttempts = 1
+	a := newTestDBWallet(t, store, 1000_00)
+	b := newTestDBWallet(t, store, 1000_00)
+
+	const rounds = 50
+	errs := make(chan error, 2*rounds)
+	var wg sync.WaitGroup
+	for i := 0; i < rounds; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := store.Transfer(context.Background(), a.ID, b.ID, 3_00, TransferOptions{})
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := store.Transfer(context.Background(), b.ID, a.ID, 1_00, TransferOptions{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "40P01" {
+			t.Fatalf("deadlock between concurrent transfers: %v", err)
+		}
+		if err != nil {
+			t.Errorf("Transfer: %v", err)
+		}
+	}
+
+	for id, want := range map[string]Amount{a.ID: 1000_00 - rounds*2_00, b.ID: 1000_00 + rounds*2_00} {
+		wallet, err := store.GetWallet(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wallet.Balance != want {
+			t.Errorf("wallet %s balance = %s, want %s", id, wallet.Balance, want)
+		}
+	}
+}
+
+func TestTransferAmountPrecision(t *testing.T) {
+	tests := []struct {
+		currency   string
+		amount     string
+		wantStatus int
+		wantError  string
+	}{
+		{currency: "USD", amount: "10.01", wantStatus: http.StatusOK},
+		{currency: "USD", amount: "10.001", wantStatus: http.StatusBadRequest, wantError: "more than 2 decimal places"},
+		{currency: "EUR", amount: "0.01", wantStatus: http.StatusOK},
+		{currency: "JPY", amount: "10", wantStatus: http.StatusOK},
+		{currency: "JPY", amount: "10.5", wantStatus: http.StatusBadRequest, wantError: "amount 10.50 exceeds JPY precision (0 decimal places)"},
+		{currency: "KRW", amount: "1.01", wantStatus: http.StatusBadRequest, wantError: "amount 1.01 exceeds KRW precision (0 decimal places)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.currency+" "+tt.amount, func(t *testing.T) {
+			store := NewMemStore()
+			ctx := context.Background()
+			from, err := store.CreateWallet(ctx, tt.currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.wallets[from.ID].Balance = 100_00
+			to, err := store.CreateWallet(ctx, tt.currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := NewHTTPHandler(store)
+
+			rec := httptest.NewRecorder()
+			h.TransferHandler(rec, walletRequest(http.MethodPost, "/api/v1/wallet/"+from.ID+"/send", from.ID, `{"to":"`+to.ID+`","amount":"`+tt.amount+`"}`))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantError == "" {
+				return
+			}
+			if msg, _ := decodeBody(t, rec)["error"].(string); !strings.Contains(msg, tt.wantError) {
+				t.Errorf("error = %q, want mention of %q", msg, tt.wantError)
+			}
+			if wallet, _ := store.GetWallet(ctx, from.ID); wallet.Balance != 100_00 {
+				t.Errorf("sender balance = %s after a rejected transfer", wallet.Balance)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemStore хранит кошельки и транзакции в памяти процесса. Предназначен для локального запуска
+// и тестов обработчиков без PostgreSQL; данные теряются при перезапуске. Правила категоризации,
+// автоматический вывод и аудит не поддерживаются.
+type MemStore struct {
+	storeConfig
+
+	// mu защищает все данные хранилища, поэтому перевод выполняется атомарно целиком
+	mu           sync.Mutex
+	wallets      map[string]*Wallet
+	transactions []Transaction
+	nextID       int64
+	idempotency  map[memIdempotencyKey]memIdempotentResult
+}
+
+// memIdempotencyKey идентифицирует ключ идемпотентности в его области
+type memIdempotencyKey struct {
+	scope string
+	key   string
+}
+
+// memIdempotentResult хранит результат перевода, проведенного с ключом идемпотентности
+type memIdempotentResult struct {
+	result  TransferResult
+	created time.Time
+}
+
+// NewMemStore создает новый экземпляр MemStore
+func NewMemStore() *MemStore {
+	return &MemStore{
+		storeConfig: defaultStoreConfig(),
+		wallets:     make(map[string]*Wallet),
+		idempotency: make(map[memIdempotencyKey]memIdempotentResult),
+	}
+}
+
+// CreateWallet создает новый кошелек в указанной валюте, пустая строка означает базовую валюту
+func (s *MemStore) CreateWallet(ctx context.Context, currency string) (*Wallet, error) {
+	if currency == "" {
+		currency = s.baseCurrency
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := uuid.New().String()
+	if _, ok := s.wallets[id]; ok {
+		return nil, ErrWalletExists
+	}
+
+	wallet := &Wallet{
+		ID:       id,
+		Balance:  s.initialBalance,
+		Currency: currency,
+		Active:   true,
+	}
+	s.wallets[id] = wallet
+
+	created := *wallet
+	return &created, nil
+}
+
+// GetWallet возвращает кошелек по его ID
+func (s *MemStore) GetWallet(ctx context.Context, walletID string) (*Wallet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wallet, ok := s.wallets[walletID]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+
+	found := *wallet
+	return &found, nil
+}
+
+// Transfer осуществляет перевод средств между кошельками с теми же проверками, что и DBStore.
+// Все изменения выполняются под одной блокировкой, поэтому перевод либо проводится целиком, либо не проводится.
+func (s *MemStore) Transfer(ctx context.Context, fromID, toID string, amount Amount, opts TransferOptions) (*TransferResult, error) {
+	err := s.validateTransfer(fromID, toID, amount, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FeePayer == "" {
+		opts.FeePayer = FeePayerSender
+	}
+	fee, debit, credit := s.fees.apply(amount, opts.FeePayer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	idempotencyKey := memIdempotencyKey{scope: s.idempotencyScope(fromID, opts), key: opts.IdempotencyKey}
+	if opts.IdempotencyKey != "" {
+		stored, ok := s.idempotency[idempotencyKey]
+		if ok && now.Sub(stored.created) < s.idempotencyTTL {
+			replayed := stored.result
+			replayed.Replayed = true
+			return &replayed, nil
+		}
+	}
+
+	from, ok := s.wallets[fromID]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+	if !from.Active {
+		return nil, ErrWalletInactive
+	}
+	if err := amount.checkPrecision(from.Currency); err != nil {
+		return nil, err
+	}
+	if from.Balance+s.overdraftLimit < debit {
+		return nil, ErrInsufficientFunds
+	}
+
+	var duplicate bool
+	if s.duplicateWindow > 0 {
+		for _, transaction := range s.transactions {
+			if transaction.From == fromID && transaction.To == toID && transaction.Amount == amount && now.Sub(transaction.Time) <= s.duplicateWindow {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate && s.rejectDuplicates {
+			return nil, ErrDuplicateTransfer
+		}
+	}
+
+	to, ok := s.wallets[toID]
+	if !ok && (opts.CreateRecipient || s.autoCreateRecipient) {
+		to = &Wallet{ID: toID, Currency: from.Currency, Active: true}
+		s.wallets[toID] = to
+		ok = true
+	}
+	if !ok {
+		return nil, ErrRecipientNotFound
+	}
+	if !to.Active {
+		return nil, fmt.Errorf("recipient %w", ErrWalletInactive)
+	}
+	if to.Currency != from.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+
+	balanceBefore := from.Balance
+	from.Balance -= debit
+	from.Version++
+	to.Balance += credit
+	to.Version++
+
+	records := s.records(Transaction{
+		Time:       now,
+		From:       fromID,
+		To:         toID,
+		Amount:     amount,
+		Fee:        fee,
+		FeePayer:   opts.FeePayer,
+		ReceiptRef: opts.ReceiptRef,
+	})
+	for i := range records {
+		s.nextID++
+		records[i].ID = s.nextID
+	}
+	s.transactions = append(s.transactions, records...)
+
+	result := &TransferResult{
+		Message:               "transfer successful",
+		Amount:                amount,
+		Fee:                   fee,
+		TotalDebited:          debit,
+		BalanceBefore:         balanceBefore,
+		BalanceAfter:          from.Balance,
+		RecipientBalanceAfter: to.Balance,
+		DuplicateWarning:      duplicate,
+		Transaction:           &records[0],
+	}
+	if len(records) > 1 {
+		result.FeeTransaction = &records[1]
+	}
+
+	if opts.IdempotencyKey != "" {
+		s.idempotency[idempotencyKey] = memIdempotentResult{result: *result, created: now}
+	}
+
+	return result, nil
+}
+
+// GetHistory возвращает транзакции кошелька, подходящие под фильтр, начиная с самых новых
+func (s *MemStore) GetHistory(ctx context.Context, walletID string, filter HistoryFilter, limit, offset int) ([]Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.wallets[walletID]; !ok {
+		return nil, ErrWalletNotFound
+	}
+
+	// Транзакции добавляются в порядке времени, поэтому обход с конца дает самые новые первыми
+	var matched []Transaction
+	for i := len(s.transactions) - 1; i >= 0; i-- {
+		transaction := s.transactions[i]
+		switch filter.Direction {
+		case "in":
+			if transaction.To != walletID {
+				continue
+			}
+		case "out":
+			if transaction.From != walletID {
+				continue
+			}
+		default:
+			if transaction.From != walletID && transaction.To != walletID {
+				continue
+			}
+		}
+		if !filter.From.IsZero() && transaction.Time.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !transaction.Time.Before(filter.To) {
+			continue
+		}
+		matched = append(matched, transaction)
+	}
+
+	if offset >= len(matched) {
+		return nil, nil
+	}
+	matched = matched[offset:]
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+// Ping всегда успешен: хранилищу в памяти не нужны внешние зависимости
+func (s *MemStore) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics содержит метрики сервиса. У каждого экземпляра свой реестр, поэтому
+// создание нескольких обработчиков (например, в тестах) не приводит к повторной регистрации.
+type metrics struct {
+	registry        *prometheus.Registry
+	transfers       *prometheus.CounterVec
+	transferAmounts prometheus.Histogram
+	requestDuration *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		transfers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ewallet_transfers_total",
+			Help: "Количество переводов по результату.",
+		}, []string{"outcome"}),
+		transferAmounts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ewallet_transfer_amount",
+			Help:    "Суммы успешных переводов.",
+			Buckets: prometheus.ExponentialBuckets(1, 10, 7),
+		}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ewallet_http_request_duration_seconds",
+			Help:    "Длительность обработки HTTP-запросов по маршруту.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+	}
+
+	m.registry.MustRegister(
+		m.transfers,
+		m.transferAmounts,
+		m.requestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// observeTransfer учитывает результат перевода
+func (m *metrics) observeTransfer(err error, amount float64) {
+	switch {
+	case err == nil:
+		m.transfers.WithLabelValues("success").Inc()
+		m.transferAmounts.Observe(amount)
+	case errors.Is(err, ErrInsufficientFunds):
+		m.transfers.WithLabelValues("insufficient_funds").Inc()
+	default:
+		m.transfers.WithLabelValues("error").Inc()
+	}
+}
+
+// middleware записывает длительность запросов с меткой шаблона маршрута,
+// чтобы ID кошельков не порождали отдельные временные ряды
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		next.ServeHTTP(w, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		m.requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(started).Seconds())
+	})
+}
+
+// handler отдает метрики в формате Prometheus
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
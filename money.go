@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// amountDigits задает число знаков после запятой, с которым хранятся суммы: балансы и суммы
+// хранятся целым числом минимальных единиц валюты (сотых долей), поэтому арифметика точная.
+// Триггер transactions_notify в schema.sql переводит суммы в основные единицы, деля на 100,
+// и должен меняться вместе с amountDigits.
+const amountDigits = 2
+
+// amountUnit — число минимальных единиц в основной, 10^amountDigits. Запросы, переводящие
+// суммы в основные единицы, получают его параметром, а не записывают делитель в тексте SQL.
+const amountUnit = 100
+
+// Amount представляет денежную сумму в минимальных единицах валюты. В JSON записывается
+// десятичным числом в основных единицах, например 12.30, а принимается числом или строкой.
+type Amount int64
+
+// Money представляет сумму объектом с валютой, например {"amount": "100.00", "currency": "USD"}.
+// Сумма записывается строкой, чтобы клиент не терял точность при разборе.
+type Money struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// amountPattern описывает десятичную запись суммы; целая часть ограничена,
+// чтобы суммы балансов не переполняли int64
+var amountPattern = regexp.MustCompile(`^(-?)([0-9]{1,15})(?:\.([0-9]+))?$`)
+
+// ParseAmount разбирает десятичную запись суммы без потери точности. Значащих знаков
+// после запятой может быть не больше amountDigits, незначащие нули допускаются.
+func ParseAmount(s string) (Amount, error) {
+	m := amountPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("%w: %q is not a decimal number", ErrInvalidAmount, s)
+	}
+
+	fraction := strings.TrimRight(m[3], "0")
+	if len(fraction) > amountDigits {
+		return 0, fmt.Errorf("%w: %q has more than %d decimal places", ErrInvalidAmount, s, amountDigits)
+	}
+	fraction += strings.Repeat("0", amountDigits-len(fraction))
+
+	v, err := strconv.ParseInt(m[2]+fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if m[1] == "-" {
+		v = -v
+	}
+	return Amount(v), nil
+}
+
+// String возвращает десятичную запись суммы в основных единицах
+func (a Amount) String() string {
+	return formatMinor(int64(a), amountDigits)
+}
+
+// Float64 возвращает приближенное значение суммы в основных единицах для метрик
+func (a Amount) Float64() float64 {
+	f, _ := strconv.ParseFloat(a.String(), 64)
+	return f
+}
+
+// MarshalJSON записывает сумму числом с amountDigits знаками после запятой
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON принимает сумму числом или строкой; null оставляет значение без изменений
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	v, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// display возвращает сумму в основных единицах, деленную на scale (степень 10), и округленную
+// до precision знаков после запятой; отрицательная precision означает без округления.
+// Деление на степень 10 лишь сдвигает запятую, поэтому результат точный.
+func (a Amount) display(scale int64, precision int) json.Number {
+	digits := amountDigits
+	for s := scale; s > 1; s /= 10 {
+		digits++
+	}
+
+	v := int64(a)
+	if precision >= 0 && precision < digits {
+		unit := int64(1)
+		for i := precision; i < digits; i++ {
+			unit *= 10
+		}
+		// Округление половины от нуля, как math.Round
+		half := unit / 2
+		if v < 0 {
+			half = -half
+		}
+		v = (v + half) / unit
+		digits = precision
+	}
+	return json.Number(formatMinor(v, digits))
+}
+
+// formatMinor записывает v·10^-digits десятичной дробью с digits знаками после запятой
+func formatMinor(v int64, digits int) string {
+	sign := ""
+	u := uint64(v)
+	if v < 0 {
+		sign = "-"
+		u = -u
+	}
+	s := strconv.FormatUint(u, 10)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+// currencyDigits содержит число знаков после запятой для валют, у которых оно отличается от двух.
+// Валюты с тремя знаками не поддерживаются, так как суммы хранятся в сотых долях.
+var currencyDigits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// minorDigits возвращает число знаков после запятой в суммах валюты
+func minorDigits(currency string) int {
+	if digits, ok := currencyDigits[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// supportedCurrency проверяет, что суммы в валюте представимы в сотых долях
+func supportedCurrency(currency string) bool {
+	return currencyPattern.MatchString(currency) && minorDigits(currency) <= amountDigits
+}
+
+// fitsCurrency проверяет, что в сумме не больше знаков после запятой, чем допускает валюта
+func (a Amount) fitsCurrency(currency string) bool {
+	unit := int64(1)
+	for i := minorDigits(currency); i < amountDigits; i++ {
+		unit *= 10
+	}
+	return int64(a)%unit == 0
+}
+
+// checkPrecision возвращает ErrAmountPrecision с названием валюты и допустимым числом знаков,
+// если сумма точнее, чем позволяет валюта
+func (a Amount) checkPrecision(currency string) error {
+	if a.fitsCurrency(currency) {
+		return nil
+	}
+	return fmt.Errorf("%w: amount %s exceeds %s precision (%d decimal places)", ErrAmountPrecision, a, currency, minorDigits(currency))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAmountUnitMatchesDigits(t *testing.T) {
+	if got := Amount(amountUnit).String(); got != "1.00" {
+		t.Fatalf("Amount(amountUnit) = %s, want one major unit", got)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{in: "0", want: 0},
+		{in: "12", want: 12_00},
+		{in: "12.3", want: 12_30},
+		{in: "12.30", want: 12_30},
+		{in: "12.300", want: 12_30},
+		{in: "0.01", want: 1},
+		{in: "-5.05", want: -5_05},
+		{in: "999999999999999.99", want: 999999999999999_99},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.in)
+		if err != nil {
+			t.Errorf("ParseAmount(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseAmount(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "abc", "1.001", "1e3", "1.", ".5", "+1", "1234567890123456"} {
+		_, err := ParseAmount(in)
+		if !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("ParseAmount(%q) error = %v, want ErrInvalidAmount", in, err)
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	var a Amount
+	for _, in := range []string{`10.5`, `"10.50"`} {
+		err := a.UnmarshalJSON([]byte(in))
+		if err != nil || a != 10_50 {
+			t.Errorf("UnmarshalJSON(%s) = %d, %v", in, a, err)
+		}
+	}
+	if data, _ := Amount(-7).MarshalJSON(); string(data) != "-0.07" {
+		t.Errorf("MarshalJSON = %s, want -0.07", data)
+	}
+}
+
+func TestAmountDisplay(t *testing.T) {
+	tests := []struct {
+		amount    Amount
+		scale     int64
+		precision int
+		want      string
+	}{
+		{amount: 1234_56, scale: 1, precision: -1, want: "1234.56"},
+		{amount: 1234_56, scale: 1000, precision: -1, want: "1.23456"},
+		{amount: 1234_56, scale: 1000, precision: 2, want: "1.23"},
+		{amount: 1234_56, scale: 1, precision: 0, want: "1235"},
+		{amount: 1234_50, scale: 1, precision: 0, want: "1235"},
+		{amount: -1234_50, scale: 1, precision: 0, want: "-1235"},
+		{amount: 5, scale: 1, precision: 1, want: "0.1"},
+		{amount: 5, scale: 1, precision: 4, want: "0.05"},
+	}
+	for _, tt := range tests {
+		got := tt.amount.display(tt.scale, tt.precision)
+		if string(got) != tt.want {
+			t.Errorf("Amount(%d).display(%d, %d) = %s, want %s", tt.amount, tt.scale, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestAmountFitsCurrency(t *testing.T) {
+	tests := []struct {
+		amount   Amount
+		currency string
+		want     bool
+	}{
+		{amount: 12_34, currency: "USD", want: true},
+		{amount: 12_00, currency: "JPY", want: true},
+		{amount: 12_34, currency: "JPY", want: false},
+		{amount: -12_00, currency: "KRW", want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.amount.fitsCurrency(tt.currency); got != tt.want {
+			t.Errorf("Amount(%d).fitsCurrency(%s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+
+	if supportedCurrency("KWD") {
+		t.Error("currency with three decimal places reported as supported")
+	}
+	if !supportedCurrency("EUR") || !supportedCurrency("JPY") {
+		t.Error("EUR and JPY must be supported")
+	}
+}
+
+func TestAmountCheckPrecision(t *testing.T) {
+	if err := Amount(12_00).checkPrecision("JPY"); err != nil {
+		t.Errorf("checkPrecision(JPY) for a whole amount: %v", err)
+	}
+	err := Amount(12_34).checkPrecision("JPY")
+	if !errors.Is(err, ErrAmountPrecision) {
+		t.Fatalf("checkPrecision(JPY) = %v, want ErrAmountPrecision", err)
+	}
+	if want := "amount 12.34 exceeds JPY precision (0 decimal places)"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not contain %q", err, want)
+	}
+}
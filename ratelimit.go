@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// walletRateLimiter ограничивает частоту запросов отдельно для каждого кошелька по алгоритму token bucket.
+// Создается один раз и разделяется всеми запросами.
+type walletRateLimiter struct {
+	limit rate.Limit
+	burst int
+	// idleTTL задает, через сколько после последнего запроса ограничитель кошелька удаляется
+	idleTTL time.Duration
+
+	mu       sync.Mutex
+	limiters map[string]*walletLimiter
+}
+
+// walletLimiter хранит ограничитель кошелька и время его последнего использования
+type walletLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newWalletRateLimiter(limit rate.Limit, burst int) *walletRateLimiter {
+	return &walletRateLimiter{
+		limit:    limit,
+		burst:    burst,
+		idleTTL:  10 * time.Minute,
+		limiters: make(map[string]*walletLimiter),
+	}
+}
+
+// reserve берет токен для кошелька; если токена нет, возвращает false и время до его появления
+func (l *walletRateLimiter) reserve(walletID string) (bool, time.Duration) {
+	l.mu.Lock()
+	entry, ok := l.limiters[walletID]
+	if !ok {
+		entry = &walletLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[walletID] = entry
+	}
+	entry.lastSeen = time.Now()
+	l.mu.Unlock()
+
+	reservation := entry.limiter.Reserve()
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.Delay(); delay > 0 {
+		// Отклоненный запрос не должен расходовать токен следующего
+		reservation.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// cleanup периодически удаляет ограничители кошельков, к которым давно не обращались
+func (l *walletRateLimiter) cleanup(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		l.mu.Lock()
+		for walletID, entry := range l.limiters {
+			if time.Since(entry.lastSeen) > l.idleTTL {
+				delete(l.limiters, walletID)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// withRateLimit отклоняет запросы с кодом 429, если кошелек из пути превысил допустимую частоту.
+// Без настроенного ограничителя запросы передаются без изменений.
+func (h *HTTPHandler) withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.transferLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		allowed, retryAfter := h.transferLimiter.reserve(mux.Vars(r)["walletId"])
+		if !allowed {
+			// Retry-After задается в целых секундах, поэтому округляется вверх
+			w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			h.responseError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// txRetryBaseDelay задает паузу перед первым повтором транзакции, каждая следующая вдвое длиннее
+const txRetryBaseDelay = 10 * time.Millisecond
+
+// isSerializationFailure определяет ошибки, при которых PostgreSQL откатил транзакцию из-за
+// конкурирующих транзакций: конфликт сериализации (40001) и взаимоблокировку (40P01).
+// Такую транзакцию можно безопасно выполнить заново целиком.
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
+
+// withTxRetry выполняет fn в транзакции и фиксирует ее. При конфликте сериализации или взаимоблокировке
+// транзакция откатывается и выполняется заново, всего не более txAttempts раз; остальные ошибки
+// возвращаются сразу. fn может вызываться несколько раз, поэтому не должна менять состояние вне транзакции.
+func (s *DBStore) withTxRetry(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	delay := txRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := s.runTx(ctx, opts, fn)
+		if err == nil || !isSerializationFailure(err) || attempt >= s.txAttempts {
+			return err
+		}
+
+		// Случайная пауза разводит повторы конкурирующих транзакций во времени
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// runTx выполняет fn в одной транзакции, откатывая ее при любой ошибке
+func (s *DBStore) runTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routes регистрирует маршруты сервиса. Уровень доступа задается при регистрации каждого маршрута:
+// служебные маршруты открыты, операции с кошельками требуют API-ключа, а маршруты /api/v1/admin,
+// статистика и деактивация кошелька — ключа администратора.
+func (h *HTTPHandler) routes() *mux.Router {
+	r := mux.NewRouter()
+
+	// Проверка доступа выполняется внутри аудита, поэтому отклоненные запросы тоже попадают в журнал,
+	// и до проверки ID кошелька, чтобы запрос без ключа не получал сведений о маршруте.
+	// Маршруты, которым нужен другой срок обработки, регистрируются через handleWithTimeout.
+	handleWithTimeout := func(method, path string, level authLevel, timeout time.Duration, handler http.Handler) *mux.Route {
+		return r.Handle(path, h.requireAuth(level, h.walletIDMiddleware(h.timeoutMiddleware(timeout, handler)))).Methods(method)
+	}
+	handle := func(method, path string, level authLevel, handler http.Handler) {
+		handleWithTimeout(method, path, level, h.requestTimeout, handler)
+	}
+	handleFunc := func(method, path string, level authLevel, handler http.HandlerFunc) {
+		handle(method, path, level, handler)
+	}
+
+	handle("GET", "/metrics", authPublic, h.metrics.handler())
+	handleFunc("GET", "/healthz", authPublic, h.HealthzHandler)
+	handleFunc("GET", "/readyz", authPublic, h.ReadyzHandler)
+	handleFunc("GET", "/api/v1/version", authUser, h.VersionHandler)
+	handleFunc("POST", "/api/v1/wallet", authUser, h.CreateWalletHandler)
+	handleFunc("POST", "/api/v1/wallet/{walletId}/send", authUser, h.withRateLimit(h.TransferHandler))
+	// Выгрузки OFX и QIF обслуживает тот же обработчик, но со сроком exportTimeout: маршрут с параметром
+	// format регистрируется раньше общего маршрута истории. Срок записи сервера (HTTP_WRITE_TIMEOUT)
+	// короче exportTimeout, поэтому для выгрузок он переносится.
+	handleWithTimeout("GET", "/api/v1/wallet/{walletId}/history", authUser, h.exportTimeout,
+		withWriteDeadline(h.exportTimeout, withCacheControl(h.historyCacheControl, h.GetHistoryHandler))).Queries("format", "{format:ofx|qif}")
+	handleFunc("GET", "/api/v1/wallet/{walletId}/history", authUser, withCacheControl(h.historyCacheControl, h.GetHistoryHandler))
+	handleFunc("GET", "/api/v1/wallet/{walletId}", authUser, withCacheControl(h.balanceCacheControl, h.GetWalletHandler))
+	// Остальные маршруты требуют PostgreSQL и недоступны с хранилищем в памяти
+	if h.db != nil {
+		handleFunc("POST", "/api/v1/wallet/{walletId}/send-batch", authUser, h.TransferBatchHandler)
+		// Поток событий живет дольше любого запроса и срока обработки не имеет
+		handleWithTimeout("GET", streamRoute, authUser, 0, http.HandlerFunc(h.StreamHandler))
+		handleFunc("PUT", "/api/v1/wallet/{walletId}/sweep", authUser, h.SetSweepHandler)
+		handleFunc("GET", "/api/v1/wallet/{walletId}/sweep", authUser, h.GetSweepHandler)
+		handleFunc("DELETE", "/api/v1/wallet/{walletId}/sweep", authUser, h.DeleteSweepHandler)
+		handleFunc("GET", "/api/v1/wallet/{walletId}/history/count", authUser, withCacheControl(h.historyCacheControl, h.CountHistoryHandler))
+		handleFunc("GET", "/api/v1/wallet/{walletId}/balance-series", authUser, withCacheControl(h.historyCacheControl, h.GetBalanceSeriesHandler))
+		handleFunc("GET", "/api/v1/wallet/{walletId}/recipients", authUser, withCacheControl(h.historyCacheControl, h.RecipientsHandler))
+		handleFunc("GET", "/api/v1/wallet/{walletId}/counterparty-counts", authUser, withCacheControl(h.historyCacheControl, h.CounterpartyCountsHandler))
+		handleFunc("GET", "/api/v1/wallet/{walletId}/monthly-opening", authUser, withCacheControl(h.historyCacheControl, h.MonthlyOpeningHandler))
+		handleFunc("GET", "/api/v1/wallet/{walletId}/velocity", authUser, withCacheControl(h.historyCacheControl, h.VelocityHandler))
+		handleFunc("GET", "/api/v1/wallet/{walletId}/has-transacted", authUser, withCacheControl(h.historyCacheControl, h.HasTransactedHandler))
+		handleFunc("DELETE", "/api/v1/wallet/{walletId}", authAdmin, h.DeactivateWalletHandler)
+		handleFunc("GET", "/api/v1/wallets", authUser, withCacheControl(h.balanceCacheControl, h.ListWalletsHandler))
+		handleFunc("POST", "/api/v1/wallets/last-activity", authUser, h.LastActivityHandler)
+		handleFunc("GET", "/api/v1/stats", authAdmin, h.StatsHandler)
+		handleFunc("POST", "/api/v1/admin/category-rules", authAdmin, h.CreateCategoryRuleHandler)
+		handleFunc("GET", "/api/v1/admin/category-rules", authAdmin, h.ListCategoryRulesHandler)
+		handleFunc("GET", "/api/v1/admin/audit-log", authAdmin, h.ListAuditHandler)
+		handleFunc("GET", "/api/v1/admin/wallets/dormant", authAdmin, h.DormantWalletsHandler)
+		handleFunc("GET", "/api/v1/admin/transactions/large", authAdmin, h.LargeTransactionsHandler)
+		handleFunc("GET", "/api/v1/admin/balance-distribution", authAdmin, h.BalanceDistributionHandler)
+		handleFunc("GET", "/api/v1/admin/currencies", authAdmin, h.CurrencyTotalsHandler)
+		handleFunc("GET", "/api/v1/admin/wallet/{walletId}/replay", authAdmin, h.ReplayBalanceHandler)
+	}
+	r.Use(h.metrics.middleware)
+	r.Use(h.auditMiddleware)
+
+	return r
+}
@@ -0,0 +1,177 @@
+-- Схема базы данных сервиса. Все выражения идемпотентны и применяются при старте.
+
+CREATE TABLE IF NOT EXISTS wallets (
+    id      TEXT PRIMARY KEY,
+    balance DOUBLE PRECISION NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+    time        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    from_wallet TEXT NOT NULL,
+    to_wallet   TEXT NOT NULL,
+    amount      DOUBLE PRECISION NOT NULL
+);
+
+-- Правила автоматической категоризации транзакций
+CREATE TABLE IF NOT EXISTS category_rules (
+    id          SERIAL PRIMARY KEY,
+    from_wallet TEXT,
+    to_wallet   TEXT,
+    category    TEXT NOT NULL,
+    CHECK (from_wallet IS NOT NULL OR to_wallet IS NOT NULL)
+);
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS category TEXT;
+
+-- Кэш количества транзакций кошелька, сверяется периодически
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS transaction_count BIGINT NOT NULL DEFAULT 0;
+
+-- Начальный баланс нужен для пересчета баланса по истории. Кошельки, созданные до появления
+-- столбца, начинали со 100; новые кошельки записывают его явно, а созданные переводом начинают с 0.
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS initial_balance DOUBLE PRECISION NOT NULL DEFAULT 100;
+ALTER TABLE wallets ALTER COLUMN initial_balance SET DEFAULT 0;
+
+-- Валюта кошелька (ISO 4217). Пустые значения у старых кошельков заполняются базовой валютой при старте.
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS currency TEXT;
+
+-- Версия кошелька для оптимистичной блокировки, увеличивается при каждом изменении баланса
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 0;
+
+-- Время создания кошелька для сортировки списка. Кошельки, созданные до появления столбца,
+-- получают время его добавления.
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Деактивированные кошельки не участвуют в переводах, но сохраняют историю
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT true;
+
+-- Журнал аудита изменяющих запросов к API
+CREATE TABLE IF NOT EXISTS audit_log (
+    id        BIGSERIAL PRIMARY KEY,
+    time      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    caller    TEXT NOT NULL,
+    method    TEXT NOT NULL,
+    path      TEXT NOT NULL,
+    wallet_id TEXT,
+    status    INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_wallet_id_idx ON audit_log (wallet_id);
+
+-- Транзакции неизменяемы: UPDATE и DELETE отклоняются триггером. Санкционированные
+-- операции (например, сторнирование) могут выполнить
+-- SET LOCAL ewallet.allow_transaction_changes = 'on' внутри своей транзакции.
+CREATE OR REPLACE FUNCTION transactions_immutable() RETURNS trigger AS $$
+BEGIN
+    IF current_setting('ewallet.allow_transaction_changes', true) = 'on' THEN
+        IF TG_OP = 'DELETE' THEN
+            RETURN OLD;
+        END IF;
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'transactions are append-only: % is not allowed', TG_OP
+        USING ERRCODE = 'insufficient_privilege';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS transactions_immutable ON transactions;
+CREATE TRIGGER transactions_immutable
+    BEFORE UPDATE OR DELETE ON transactions
+    FOR EACH ROW EXECUTE FUNCTION transactions_immutable();
+
+-- Ссылка на чек или квитанцию, приложенную к переводу (URL или ключ объекта в хранилище)
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS receipt_ref TEXT;
+
+-- Идентификатор транзакции
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY;
+
+-- Ключи идемпотентности переводов, уникальные в пределах области: wallet:<ID отправителя>
+-- или caller:<идентификатор API-ключа>
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope          TEXT NOT NULL,
+    key            TEXT NOT NULL,
+    transaction_id BIGINT,
+    response       JSONB,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (scope, key)
+);
+
+-- Ключи, созданные до появления областей, принадлежали кошельку отправителя
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'idempotency_keys' AND column_name = 'wallet_id'
+    ) THEN
+        ALTER TABLE idempotency_keys RENAME COLUMN wallet_id TO scope;
+        UPDATE idempotency_keys SET scope = 'wallet:' || scope;
+    END IF;
+END;
+$$;
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+
+-- Автоматический вывод излишка баланса сверх порога на целевой кошелек
+CREATE TABLE IF NOT EXISTS wallet_sweeps (
+    wallet_id     TEXT PRIMARY KEY REFERENCES wallets (id),
+    threshold     DOUBLE PRECISION NOT NULL CHECK (threshold >= 0),
+    target_wallet TEXT NOT NULL REFERENCES wallets (id),
+    CHECK (wallet_id <> target_wallet)
+);
+
+-- Комиссия за перевод и оплативший ее участник: sender или recipient
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fee DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fee_payer TEXT NOT NULL DEFAULT 'sender';
+
+-- Общий ID перевода и отдельной записи его комиссии при FEE_RECORDS=split
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS group_id UUID;
+
+-- Уведомление о новой транзакции для потоков событий кошельков. Полезная нагрузка совпадает
+-- с JSON-представлением Transaction, суммы переводятся в основные единицы; NOTIFY доставляется только после фиксации транзакции.
+-- Делитель 100 и округление до двух знаков соответствуют amountDigits = 2 в money.go.
+CREATE OR REPLACE FUNCTION transactions_notify() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('wallet_transactions', json_build_object(
+        'id', NEW.id,
+        'time', NEW.time,
+        'from', NEW.from_wallet,
+        'to', NEW.to_wallet,
+        'amount', round(NEW.amount / 100.0, 2),
+        'fee', round(NEW.fee / 100.0, 2),
+        'fee_payer', NEW.fee_payer,
+        'category', NEW.category,
+        'receipt_ref', NEW.receipt_ref,
+        'group_id', NEW.group_id
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS transactions_notify ON transactions;
+CREATE TRIGGER transactions_notify
+    AFTER INSERT ON transactions
+    FOR EACH ROW EXECUTE FUNCTION transactions_notify();
+
+-- Суммы хранятся целым числом сотых долей валюты, чтобы арифметика балансов была точной.
+-- Столбцы, созданные как DOUBLE PRECISION, переводятся в BIGINT один раз: повторный запуск их уже не находит.
+DO $$
+DECLARE
+    col record;
+BEGIN
+    FOR col IN
+        SELECT table_name::text AS table_name, column_name::text AS column_name
+        FROM information_schema.columns
+        WHERE table_schema = current_schema()
+          AND data_type = 'double precision'
+          AND (table_name::text, column_name::text) IN (
+              ('wallets', 'balance'), ('wallets', 'initial_balance'),
+              ('transactions', 'amount'), ('transactions', 'fee'),
+              ('wallet_sweeps', 'threshold'))
+    LOOP
+        EXECUTE format('ALTER TABLE %I ALTER COLUMN %I DROP DEFAULT', col.table_name, col.column_name);
+        EXECUTE format('ALTER TABLE %I ALTER COLUMN %I TYPE BIGINT USING round(%I * 100)::bigint',
+            col.table_name, col.column_name, col.column_name);
+    END LOOP;
+END;
+$$;
+ALTER TABLE wallets ALTER COLUMN initial_balance SET DEFAULT 0;
+ALTER TABLE transactions ALTER COLUMN fee SET DEFAULT 0;
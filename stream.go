@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// transactionsChannel задает канал NOTIFY, в который триггер transactions_notify публикует новые транзакции
+const transactionsChannel = "wallet_transactions"
+
+// transactionFeed раздает новые транзакции подписчикам по ID кошелька. На весь процесс открывается
+// одно соединение LISTEN, поэтому число потоков не влияет на число соединений с базой данных.
+// Уведомления доставляются при фиксации транзакции, откаченные переводы подписчики не видят.
+type transactionFeed struct {
+	listener *pq.Listener
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan Transaction]struct{}
+	closed      bool
+}
+
+// newTransactionFeed подписывается на канал transactionsChannel по dsn. Соединение
+// переустанавливается автоматически; уведомления за время разрыва теряются.
+func newTransactionFeed(dsn string) (*transactionFeed, error) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("transaction feed: %v", err)
+		}
+	})
+	err := listener.Listen(transactionsChannel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	feed := &transactionFeed{
+		listener:    listener,
+		subscribers: make(map[string]map[chan Transaction]struct{}),
+	}
+	go feed.run()
+	return feed, nil
+}
+
+func (f *transactionFeed) run() {
+	for notification := range f.listener.Notify {
+		// nil приходит после переподключения
+		if notification == nil {
+			log.Printf("transaction feed reconnected, notifications may have been lost")
+			continue
+		}
+
+		var transaction Transaction
+		err := json.Unmarshal([]byte(notification.Extra), &transaction)
+		if err != nil {
+			log.Printf("transaction feed: invalid notification %q: %v", notification.Extra, err)
+			continue
+		}
+		f.publish(transaction)
+	}
+}
+
+// publish отправляет транзакцию подписчикам отправителя и получателя. Подписчик, не успевающий
+// читать события, отключается, чтобы не задерживать остальных; клиент может переподключиться.
+func (f *transactionFeed) publish(transaction Transaction) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, walletID := range []string{transaction.From, transaction.To} {
+		for ch := range f.subscribers[walletID] {
+			select {
+			case ch <- transaction:
+			default:
+				f.remove(walletID, ch)
+			}
+		}
+	}
+}
+
+// subscribe возвращает канал новых транзакций кошелька и функцию отписки.
+// Канал закрывается при отписке, отключении медленного подписчика и остановке сервиса.
+func (f *transactionFeed) subscribe(walletID string) (<-chan Transaction, func()) {
+	ch := make(chan Transaction, 64)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if f.subscribers[walletID] == nil {
+		f.subscribers[walletID] = make(map[chan Transaction]struct{})
+	}
+	f.subscribers[walletID][ch] = struct{}{}
+
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.remove(walletID, ch)
+	}
+}
+
+// remove отписывает канал и закрывает его; вызывается под f.mu
+func (f *transactionFeed) remove(walletID string, ch chan Transaction) {
+	if _, ok := f.subscribers[walletID][ch]; !ok {
+		return
+	}
+	delete(f.subscribers[walletID], ch)
+	if len(f.subscribers[walletID]) == 0 {
+		delete(f.subscribers, walletID)
+	}
+	close(ch)
+}
+
+// close завершает все потоки и закрывает соединение LISTEN. Вызывается при остановке сервера,
+// так как открытые потоки иначе не дали бы ему дождаться завершения запросов.
+func (f *transactionFeed) close() {
+	f.mu.Lock()
+	f.closed = true
+	for walletID, subscribers := range f.subscribers {
+		for ch := range subscribers {
+			f.remove(walletID, ch)
+		}
+	}
+	f.mu.Unlock()
+
+	err := f.listener.Close()
+	if err != nil {
+		log.Printf("closing transaction feed: %v", err)
+	}
+}
+
+// StreamHandler отправляет новые транзакции кошелька как Server-Sent Events, пока клиент не отключится.
+// В паузах между событиями отправляются комментарии, чтобы прокси не закрывали простаивающее соединение.
+func (h *HTTPHandler) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	walletID := vars["walletId"]
+
+	_, err := h.store.GetWallet(r.Context(), walletID)
+	if err != nil {
+		h.responseStoreError(w, r, err)
+		return
+	}
+
+	events, unsubscribe := h.feed.subscribe(walletID)
+	defer unsubscribe()
+
+	// Поток живет дольше таймаутов сервера на чтение и запись, поэтому они снимаются для этого соединения
+	rc := http.NewResponseController(w)
+	for _, err := range []error{rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{})} {
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Отключает буферизацию ответа в nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	err = rc.Flush()
+	if err != nil {
+		log.Printf("%s %s: streaming is not supported: %v", r.Method, r.URL.Path, err)
+		return
+	}
+
+	keepAlive := time.NewTicker(h.streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case transaction, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(transaction)
+			if err != nil {
+				log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: transaction\ndata: %s\n\n", transaction.ID, data)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		}
+
+		err := rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
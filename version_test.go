@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	h := NewHTTPHandler(NewMemStore())
+	rec := httptest.NewRecorder()
+	h.VersionHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var body map[string]string
+	err := json.Unmarshal(rec.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatalf("invalid response body %q: %v", rec.Body.String(), err)
+	}
+	// В тестах коммит и время сборки могут быть unknown, но поля должны присутствовать
+	for _, field := range []string{"version", "commit", "build_time", "go_version"} {
+		if body[field] == "" {
+			t.Errorf("field %s is missing or empty in %s", field, rec.Body.String())
+		}
+	}
+	if body["go_version"] != runtime.Version() {
+		t.Errorf("go_version = %q, want %q", body["go_version"], runtime.Version())
+	}
+}
+
+// Значения, переданные через -ldflags, имеют приоритет над данными VCS
+func TestBuildInfoLdflags(t *testing.T) {
+	defer func(v, c, b string) { version, commit, buildTime = v, c, b }(version, commit, buildTime)
+	version, commit, buildTime = "1.2.0", "abc123", "2024-03-01T12:00:00Z"
+
+	info := buildInfo()
+	if info.Version != "1.2.0" || info.Commit != "abc123" || info.BuildTime != "2024-03-01T12:00:00Z" {
+		t.Errorf("buildInfo = %+v, want values from ldflags", info)
+	}
+}